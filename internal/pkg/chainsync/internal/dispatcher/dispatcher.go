@@ -1,24 +1,117 @@
 package dispatcher
 
 import (
+	"bytes"
 	"container/heap"
+	"container/list"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
 
 	"github.com/filecoin-project/go-filecoin/internal/pkg/block"
+	"github.com/filecoin-project/go-filecoin/internal/pkg/clock"
+	"github.com/filecoin-project/go-filecoin/internal/pkg/metrics"
 	"github.com/filecoin-project/go-filecoin/internal/pkg/util/moresync"
+	"github.com/filecoin-project/specs-actors/actors/abi"
 )
 
 var log = logging.Logger("chainsync.dispatcher")
 
+var syncTimeoutCt = metrics.NewInt64Counter("chainsync/dispatcher_sync_timeout", "Number of target syncs cancelled and requeued for exceeding the sync deadline")
+
 // DefaultInQueueSize is the size of the channel used for receiving targets from producers.
 const DefaultInQueueSize = 5
 
 // DefaultWorkQueueSize is the size of the work queue
 const DefaultWorkQueueSize = 20
 
+// DefaultDuplicateSampleSize is the number of dropped duplicate targets logged
+// per DefaultDuplicateSampleInterval.
+const DefaultDuplicateSampleSize = 5
+
+// DefaultDuplicateSampleInterval is the interval over which dropped duplicate
+// targets are sampled for logging.
+const DefaultDuplicateSampleInterval = time.Minute
+
+// DefaultRecentDropsSize is the number of dropped targets retained for
+// RecentDrops.
+const DefaultRecentDropsSize = 32
+
+// DefaultMaxSyncRetries is the number of times a target whose sync ran past
+// the sync deadline is requeued before it is dropped.
+const DefaultMaxSyncRetries = 3
+
+// AttemptLogSize is the number of failed sync attempts retained per head for
+// AttemptLog.
+const AttemptLogSize = 16
+
+// AttemptLogHeads is the number of heads whose failed sync attempts are
+// retained for AttemptLog.  The logs of the least recently failed heads are
+// evicted first.
+const AttemptLogHeads = 1024
+
+// DefaultTipGap is the largest gap between a target and the chain head for
+// which the target is classified as a tip sync.
+const DefaultTipGap = 1
+
+// DefaultDeepGap is the largest gap between a target and the chain head for
+// which the target is classified as a shallow sync.  It matches the gap that
+// triggers catchup.
+const DefaultDeepGap = MaxEpochGap
+
+// DefaultAnnouncementWindow is how long a peer's latest announcement counts
+// towards agreement on the network's head.
+const DefaultAnnouncementWindow = 5 * time.Minute
+
+// DefaultQuarantineWindow is how long a target sent only by suspect peers
+// waits for a non-suspect peer to corroborate it.
+const DefaultQuarantineWindow = time.Minute
+
+// DefaultQuarantinePerSuspect is the number of targets from a single suspect
+// peer that may wait in quarantine at once.
+const DefaultQuarantinePerSuspect = 4
+
+// DefaultQuarantineSize is the number of targets that may wait in quarantine
+// at once.
+const DefaultQuarantineSize = 64
+
+// Reasons the dispatcher drops targets, as reported by DropReasons.
+const (
+	// DropReasonDuplicate counts targets whose head is already queued.
+	DropReasonDuplicate = "duplicate"
+	// DropReasonFull counts targets arriving when the work queue is full.
+	DropReasonFull = "full"
+	// DropReasonStale counts queued targets pruned for falling below the
+	// chain head.
+	DropReasonStale = "stale"
+	// DropReasonExpired counts targets that expired before they were synced.
+	DropReasonExpired = "expired"
+	// DropReasonSubsumed counts targets whose head is an ancestor of another
+	// target's head.
+	DropReasonSubsumed = "subsumed"
+	// DropReasonUncorroborated counts targets from suspect peers that no
+	// other peer sent within the quarantine window.
+	DropReasonUncorroborated = "uncorroborated"
+	// DropReasonRetries counts targets dropped after their syncs ran past
+	// the sync deadline more than the maximum number of retries.
+	DropReasonRetries = "retries"
+	// DropReasonQuarantineFull counts targets from suspect peers arriving
+	// when the quarantine, or the sender's share of it, is full.
+	DropReasonQuarantineFull = "quarantine full"
+)
+
 // MaxEpochGap is the maximum number of epochs chainsync can fall behind
 // before catching up
 const MaxEpochGap = 10
@@ -38,22 +131,340 @@ type chainHeadState interface {
 	GetTipSet(block.TipSetKey) (block.TipSet, error)
 }
 
+// AncestryOracle answers ancestry questions between tipsets.  It is the one
+// source of ancestry for every dispatcher policy needing it.  Answers must be
+// conservative: when ancestry is unknown an oracle returns false.
+type AncestryOracle interface {
+	// IsAncestor returns true if ancestor is known to be an ancestor of
+	// descendant.
+	IsAncestor(ancestor, descendant block.TipSetKey) (bool, error)
+	// DescendsFrom returns true if descendant is known to descend from
+	// ancestor.
+	DescendsFrom(descendant, ancestor block.TipSetKey) (bool, error)
+}
+
+// noopAncestryOracle is the default oracle, it knows no ancestry.
+type noopAncestryOracle struct{}
+
+func (noopAncestryOracle) IsAncestor(_, _ block.TipSetKey) (bool, error) {
+	return false, nil
+}
+
+func (noopAncestryOracle) DescendsFrom(_, _ block.TipSetKey) (bool, error) {
+	return false, nil
+}
+
+// DispatcherOption is the type of the dispatcher's functional options.
+type DispatcherOption func(*Dispatcher)
+
+// WithComparators returns an option that orders the work queue by the given
+// comparators.  Each comparator is consulted in turn until one of them
+// prefers one target over the other.
+func WithComparators(cmps []Comparator) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.comparators = cmps
+	}
+}
+
+// WithUrgency returns an option that syncs targets with a higher urgency
+// first, for example targets advancing the chain past a deadline a storage
+// provider is waiting on.  Equally urgent targets are ordered by the
+// dispatcher's comparators.
+func WithUrgency(urgency func(block.ChainInfo) int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.urgency = urgency
+	}
+}
+
+// WithClock returns an option that sets the dispatcher's clock.
+func WithClock(c clock.Clock) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.clock = c
+	}
+}
+
+// WithDuplicateSampling returns an option that logs a random sample of at
+// most size dropped duplicate targets every interval.  The sample is drawn
+// with rng, or a source seeded from the clock if rng is nil.  A negative
+// size is treated as 0, disabling the sample.
+func WithDuplicateSampling(size int, interval time.Duration, rng *rand.Rand) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.dupSample = newReservoir(size, rng)
+		d.dupInterval = interval
+	}
+}
+
+// WithTransform returns an option that rewrites the chain info of every
+// received target before it is deduplicated and queued, for example to
+// normalize or enrich it.  A nil transform leaves chain infos unchanged.
+func WithTransform(transform func(block.ChainInfo) block.ChainInfo) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.transform = transform
+	}
+}
+
+// WithScorer returns an option that orders the work queue by scores computed
+// once per target when it is queued, instead of by the comparators.  Use this
+// when prioritizing requires expensive lookups.
+func WithScorer(score Scorer) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.scorer = score
+	}
+}
+
+// WithHeadHeight returns an option giving the dispatcher access to the height
+// of the node's chain head.
+func WithHeadHeight(headHeight func() (abi.ChainEpoch, error)) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.headHeight = headHeight
+	}
+}
+
+// WithStalePruning returns an option that removes queued targets below the
+// chain head every interval.  onEvict, if not nil, is called with each
+// removed target.  Pruning requires the WithHeadHeight option.
+func WithStalePruning(interval time.Duration, onEvict func(Target)) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.pruneInterval = interval
+		d.onEvict = onEvict
+	}
+}
+
+// WithDedupKey returns an option that deduplicates queued targets on the
+// given key instead of on their chain head, for example to collapse targets
+// sharing a parent.
+func WithDedupKey(key func(block.ChainInfo) string) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.dedupKey = key
+	}
+}
+
+// WithAnnouncementWindow returns an option setting how long a peer's latest
+// announcement counts towards agreement on the network's head.
+func WithAnnouncementWindow(window time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.announcementWindow = window
+	}
+}
+
+// WithSyncClassGaps returns an option setting the thresholds Classify uses:
+// targets at most tipGap above the chain head are tip syncs, targets more
+// than deepGap above it are deep syncs and the rest are shallow syncs.
+func WithSyncClassGaps(tipGap, deepGap abi.ChainEpoch) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.tipGap = tipGap
+		d.deepGap = deepGap
+	}
+}
+
+// WithReservedCapacity returns an option reserving the given fraction of the
+// work queue for targets from hello messages, the node's own blocks and
+// operators.  Gossip targets can never take up reserved space, so a flood of
+// gossip can't crowd out these higher priority sources.  The fraction is
+// clamped to [0, 1].
+func WithReservedCapacity(fraction float64) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.reservedFraction = math.Min(math.Max(fraction, 0), 1)
+	}
+}
+
+// WithRecentDropsSize returns an option setting how many of the most recently
+// dropped targets are retained for RecentDrops.  A negative size is treated
+// as 0, retaining none.
+func WithRecentDropsSize(size int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.recentDrops = newDropRing(size)
+	}
+}
+
+// WithReorderInterval returns an option batching the work queue's heap
+// reordering so it happens at most once per interval, bounding the
+// comparator calls spent on bursts of pushes.  See
+// TargetQueue.SetReorderInterval.
+func WithReorderInterval(interval time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.reorderInterval = interval
+	}
+}
+
+// WithDepthThresholds returns an option calling onCross whenever the work
+// queue's depth crosses one of the thresholds.  crossedUp is true if the
+// depth rose to at least the threshold and false if it fell below it.
+// Depth is observed after each batch of incoming targets is queued and a
+// target popped, and after targets are removed, requeued, flushed or
+// imported.  onCross is called once at a time, in the order the crossings
+// happened.
+func WithDepthThresholds(onCross func(threshold int, crossedUp bool), thresholds ...int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.onDepthThreshold = onCross
+		d.depthThresholds = thresholds
+	}
+}
+
+// WithAncestryOracle returns an option giving the dispatcher knowledge of
+// tipset ancestry.  With it the dispatcher subsumes targets: a target whose
+// head is an ancestor of a queued head is dropped, and queued targets whose
+// heads are ancestors of a new target's head are removed, as syncing the
+// descendant syncs them too.  Forced targets are never subsumed.
+func WithAncestryOracle(oracle AncestryOracle) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.ancestry = oracle
+	}
+}
+
+// WithPeerLatency returns an option breaking ties between targets the
+// comparators can't separate in favor of targets whose sender, the peer
+// serving their blocks, has the lower measured latency.  It applies before
+// the tie strategy and does not apply to scored queues.  Latencies may change
+// over time, the work queue is reordered before each pop.  latency is called
+// with the dispatcher's lock held and should be cheap.
+func WithPeerLatency(latency func(peer.ID) time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.peerLatency = latency
+	}
+}
+
+// WithTieStrategy returns an option choosing how the dispatcher breaks ties
+// between distinct targets its comparators can't separate.  Tie strategies
+// do not apply to scored queues.
+func WithTieStrategy(strategy TieStrategy) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.tieStrategy = strategy
+	}
+}
+
+// WithQuarantineWindow returns an option setting how long targets sent only
+// by suspect peers are quarantined awaiting corroboration.
+func WithQuarantineWindow(window time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.quarantineWindow = window
+	}
+}
+
+// WithQuarantineLimits returns an option setting how many targets sent only
+// by suspect peers may wait in quarantine at once, from a single suspect peer
+// and overall.  Targets beyond either limit are dropped.
+func WithQuarantineLimits(perSuspect, size int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.quarantinePerSuspect = perSuspect
+		d.quarantineSize = size
+	}
+}
+
+// WithPriorityBands returns an option ordering targets by the priority of the
+// band they fall in before the dispatcher's comparators.  A target belongs
+// to the first band whose MaxDistance is at least the target's distance to
+// the chain head, targets in no band have priority 0.  Bands require the
+// WithHeadHeight option.
+func WithPriorityBands(bands []PriorityBand) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.bands = bands
+	}
+}
+
+// WithSyncDeadline returns an option limiting how long a single target may
+// be synced.  A sync running past the deadline is cancelled and its target
+// is requeued with an incremented retry count.  Retried targets are synced
+// after all targets with fewer retries, and dropped once they exceed the
+// maximum number of retries.
+func WithSyncDeadline(deadline time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.syncDeadline = deadline
+	}
+}
+
+// WithMaxSyncRetries returns an option setting how many times a target whose
+// sync ran past the sync deadline is requeued before it is dropped.  The
+// registered callback is called with an error for a dropped target.
+func WithMaxSyncRetries(retries int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.maxSyncRetries = retries
+	}
+}
+
 // NewDispatcher creates a new syncing dispatcher with default queue sizes.
-func NewDispatcher(catchupSyncer dispatchSyncer, trans Transitioner) *Dispatcher {
-	return NewDispatcherWithSizes(catchupSyncer, trans, DefaultWorkQueueSize, DefaultInQueueSize)
+func NewDispatcher(catchupSyncer dispatchSyncer, trans Transitioner, opts ...DispatcherOption) *Dispatcher {
+	return NewDispatcherWithSizes(catchupSyncer, trans, DefaultWorkQueueSize, DefaultInQueueSize, opts...)
 }
 
 // NewDispatcherWithSizes creates a new syncing dispatcher.
-func NewDispatcherWithSizes(syncer dispatchSyncer, trans Transitioner, workQueueSize, inQueueSize int) *Dispatcher {
-	return &Dispatcher{
-		workQueue:     NewTargetQueue(),
+func NewDispatcherWithSizes(syncer dispatchSyncer, trans Transitioner, workQueueSize, inQueueSize int, opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
 		workQueueSize: workQueueSize,
 		syncer:        syncer,
 		transitioner:  trans,
 		incoming:      make(chan Target, inQueueSize),
 		control:       make(chan interface{}, 1),
+		popsResumed:   make(chan struct{}, 1),
+		quarantineSet: make(chan struct{}, 1),
 		registeredCb:  func(t Target, err error) {},
+		dropCounts:    make(map[string]uint64),
+		recentDrops:   newDropRing(DefaultRecentDropsSize),
+		clock:         clock.NewSystemClock(),
+		dupSample:     newReservoir(DefaultDuplicateSampleSize, nil),
+		dupInterval:   DefaultDuplicateSampleInterval,
+
+		announcements:        make(map[peer.ID]announcement),
+		announcementWindow:   DefaultAnnouncementWindow,
+		announceCounts:       make(map[peer.ID]uint64),
+		headPeers:            make(map[string]int),
+		suspects:             make(map[peer.ID]struct{}),
+		quarantine:           make(map[string]quarantined),
+		attempts:             newAttemptLogs(AttemptLogHeads),
+		watched:              make(map[abi.ChainEpoch]struct{}),
+		quarantineWindow:     DefaultQuarantineWindow,
+		quarantinedBy:        make(map[peer.ID]int),
+		quarantinePerSuspect: DefaultQuarantinePerSuspect,
+		quarantineSize:       DefaultQuarantineSize,
+		tipGap:               DefaultTipGap,
+		deepGap:              DefaultDeepGap,
+		ancestry:             noopAncestryOracle{},
+		maxSyncRetries:       DefaultMaxSyncRetries,
+	}
+	for _, opt := range opts {
+		opt(d)
 	}
+	d.dupWindowStart = d.clock.Now()
+	d.gossipCapacity = workQueueSize - int(d.reservedFraction*float64(workQueueSize))
+	if d.scorer != nil {
+		d.workQueue = NewTargetQueue(d.byWatched, byMemoizedScore)
+		d.workQueue.scorer = d.scorer
+	} else {
+		d.workQueue = NewTargetQueue(d.queueComparators()...)
+	}
+	if d.dedupKey != nil {
+		d.workQueue.dedupKey = d.dedupKey
+	}
+	if d.reorderInterval > 0 {
+		d.workQueue.SetReorderInterval(d.clock, d.reorderInterval)
+	}
+	return d
+}
+
+// queueComparators returns the full chain of comparators ordering the work
+// queue.
+func (d *Dispatcher) queueComparators() []Comparator {
+	cmps := d.comparators
+	if len(cmps) == 0 {
+		cmps = []Comparator{ByHeight}
+	}
+	if len(d.bands) > 0 && d.headHeight != nil {
+		cmps = append([]Comparator{byBand(d.bands, d.bandHeadHeight)}, cmps...)
+	}
+	if d.urgency != nil {
+		cmps = append([]Comparator{byUrgency(d.urgency)}, cmps...)
+	}
+	cmps = append([]Comparator{d.byWatched}, cmps...)
+	if d.peerLatency != nil {
+		cmps = append(cmps, byPeerLatency(d.peerLatency))
+	}
+	switch d.tieStrategy {
+	case TieMostPeers:
+		cmps = append(cmps, d.byMostPeers, bySmallestHead)
+	case TieSmallestHead:
+		cmps = append(cmps, bySmallestHead)
+	}
+	return cmps
 }
 
 // cbMessage registers a user callback to be fired following every successful
@@ -74,15 +485,96 @@ type cbMessage struct {
 // controls. Currently there is only one kind of control message.  It registers
 // a callback that the dispatcher will call after every non-erroring sync.
 type Dispatcher struct {
+	// lk guards the state read and modified from outside the dispatcher's
+	// goroutine: the workQueue, inFlight, catchup and the counters.
+	lk sync.Mutex
 	// workQueue is a priority queue of target chain heads that should be
 	// synced
 	workQueue     *TargetQueue
 	workQueueSize int
+	// gossipCapacity is the number of work queue slots gossip targets may
+	// use, the remaining reservedFraction is kept for other sources.
+	gossipCapacity   int
+	reservedFraction float64
+	// comparators order the workQueue, the default is by claimed height.
+	comparators []Comparator
+	// urgency, if set, takes precedence over the bands and comparators.
+	urgency func(block.ChainInfo) int
+	// bands, if set, take precedence over the comparators.  Targets are
+	// banded by their distance from bandHead, the chain head height read once
+	// per reorder so it holds still while the queue is ordered.  bandHeadOK
+	// is false until the head height is first read.
+	bands      []PriorityBand
+	bandHead   abi.ChainEpoch
+	bandHeadOK bool
+	// transform, if set, rewrites received chain infos.
+	transform func(block.ChainInfo) block.ChainInfo
+	// scorer, if set, replaces the comparators with memoized scores.
+	scorer Scorer
+	// reorderInterval, if positive, batches the workQueue's reordering.
+	reorderInterval time.Duration
+	// dedupKey, if set, replaces the chain head as the workQueue's dedup key.
+	dedupKey func(block.ChainInfo) string
+	// headHeight, if set, returns the height of the node's chain head.
+	headHeight func() (abi.ChainEpoch, error)
+	// pruneInterval, if positive, is the interval between removals of
+	// queued targets below the chain head.  onEvict is called with each
+	// removed target.
+	pruneInterval time.Duration
+	onEvict       func(Target)
+	// onDepthThreshold is called when the work queue depth last observed,
+	// lastDepth, crosses one of depthThresholds.  pendingCrossings await
+	// delivery, which is serialized by deliveringCrossings.
+	onDepthThreshold    func(threshold int, crossedUp bool)
+	depthThresholds     []int
+	lastDepth           int
+	pendingCrossings    []depthCrossing
+	deliveringCrossings bool
+	// ancestry answers the ancestry questions of target subsumption.
+	ancestry AncestryOracle
+	// peerLatency, if set, breaks ties the comparators leave in favor of
+	// closer senders.
+	peerLatency func(peer.ID) time.Duration
+	// tieStrategy breaks ties the comparators and latency leave.
+	tieStrategy TieStrategy
+	// headPeers counts the peers whose latest announcement is each head.
+	headPeers map[string]int
+	// suspects are peers flagged as possible Sybils.  Targets only they sent
+	// wait in quarantine, by dedup key, for a non-suspect peer to send them
+	// within the quarantine window.  quarantinedBy counts the quarantined
+	// targets of each suspect, bounded by quarantinePerSuspect, and the
+	// quarantine holds at most quarantineSize targets.  quarantineSet wakes
+	// the expiry goroutine when a target is quarantined.
+	suspects             map[peer.ID]struct{}
+	quarantine           map[string]quarantined
+	quarantineWindow     time.Duration
+	quarantinedBy        map[peer.ID]int
+	quarantinePerSuspect int
+	quarantineSize       int
+	quarantineSet        chan struct{}
+	// attempts are the failed sync attempts of each head not yet synced.
+	attempts *attemptLogs
+	// syncedHeight is the greatest height of the successfully synced targets
+	// and syncedHead the head of the target synced at it.
+	syncedHeight abi.ChainEpoch
+	syncedHead   block.TipSetKey
+	// watched are heights whose targets are prioritized and never pruned.
+	watched map[abi.ChainEpoch]struct{}
+	// tipGap and deepGap are the gaps to the chain head separating tip,
+	// shallow and deep syncs.
+	tipGap  abi.ChainEpoch
+	deepGap abi.ChainEpoch
 	// incoming is the queue of incoming sync targets to the dispatcher.
 	incoming chan Target
 	// syncer is used for dispatching sync targets for chain heads to sync
 	// local chain state to these targets.
 	syncer dispatchSyncer
+	// inFlight is the target currently being synced, if any.
+	inFlight *Target
+	// syncDeadline, if positive, is how long a sync may run before it is
+	// cancelled and its target requeued, at most maxSyncRetries times.
+	syncDeadline   time.Duration
+	maxSyncRetries int
 
 	// catchup is true when the syncer is in catchup mode
 	catchup bool
@@ -94,33 +586,131 @@ type Dispatcher struct {
 	registeredCb func(Target, error)
 	// control is a queue of control messages not yet processed.
 	control chan interface{}
+	// popsPaused stops the dispatcher syncing targets while it keeps
+	// queueing them.  It is guarded by lk.  popsResumed wakes the waiting
+	// dispatcher when pops resume.
+	popsPaused  bool
+	popsResumed chan struct{}
 
 	// syncTargetCount counts the number of successful syncs.
 	syncTargetCount uint64
+	// dropCounts counts dropped targets by reason and recentDrops retains
+	// the latest dropped targets.  Both are guarded by lk.
+	dropCounts  map[string]uint64
+	recentDrops *dropRing
+
+	clock clock.Clock
+	// dupSample samples dropped duplicate targets for logging once every
+	// dupInterval.
+	dupSample      *reservoir
+	dupInterval    time.Duration
+	dupWindowStart time.Time
+
+	// announcements tracks the latest head announced by each sending peer
+	// within the announcement window.  Older announcements are pruned when
+	// read, and on receipt at most once per window since lastAnnouncePrune.
+	// It is guarded by lk.
+	announcements      map[peer.ID]announcement
+	announcementWindow time.Duration
+	lastAnnouncePrune  time.Time
+	// announceCounts counts every announcement by sending peer.  It is
+	// guarded by lk.
+	announceCounts map[peer.ID]uint64
+}
+
+// pruneAnnouncements forgets the announcements received outside the
+// announcement window.  It must be called with the lock held.
+func (d *Dispatcher) pruneAnnouncements() {
+	d.lastAnnouncePrune = d.clock.Now()
+	for p, a := range d.announcements {
+		if d.clock.Since(a.receivedAt) <= d.announcementWindow {
+			continue
+		}
+		key := a.head.String()
+		if d.headPeers[key]--; d.headPeers[key] <= 0 {
+			delete(d.headPeers, key)
+		}
+		delete(d.announcements, p)
+	}
+}
+
+// announcement is a head announced by a peer and when it was received.
+type announcement struct {
+	head       block.TipSetKey
+	height     abi.ChainEpoch
+	receivedAt time.Time
 }
 
 // SendHello handles chain information from bootstrap peers.
 func (d *Dispatcher) SendHello(ci *block.ChainInfo) error {
-	return d.enqueue(ci)
+	return d.enqueue(Target{ChainInfo: *ci, Reason: EnqueueBootstrap})
 }
 
 // SendOwnBlock handles chain info from a node's own mining system
 func (d *Dispatcher) SendOwnBlock(ci *block.ChainInfo) error {
-	return d.enqueue(ci)
+	return d.enqueue(Target{ChainInfo: *ci, Reason: EnqueueOwnBlock})
 }
 
 // SendGossipBlock handles chain info from new blocks sent on pubsub
 func (d *Dispatcher) SendGossipBlock(ci *block.ChainInfo) error {
-	return d.enqueue(ci)
+	return d.enqueue(Target{ChainInfo: *ci, Reason: EnqueueGossip})
+}
+
+// ForceTarget handles an operator-forced sync of the given chain.  Forced
+// targets bypass the comparators: they are synced before all other targets,
+// in order of decreasing priority.  Forcing an already queued head raises it
+// to the forced tier.  A forced target is queued even if the work queue is
+// full, evicting the lowest priority target that is neither forced nor
+// watched, and is never pruned as stale.  Forcing a head does not count as
+// an announcement by its sender.
+func (d *Dispatcher) ForceTarget(ci block.ChainInfo, priority int) error {
+	return d.enqueue(Target{ChainInfo: ci, Reason: EnqueueForced, forced: true, priority: priority})
+}
+
+// ReceiveWithExpiry handles chain info from a source that knows when its
+// announcement stops being valid, such as a time-limited checkpoint.  The
+// target is dropped instead of synced if it is still queued at expiry.
+func (d *Dispatcher) ReceiveWithExpiry(ci *block.ChainInfo, expiry time.Time) error {
+	return d.enqueue(Target{ChainInfo: *ci, Reason: EnqueueExpiring, expiry: expiry})
 }
 
-func (d *Dispatcher) enqueue(ci *block.ChainInfo) error {
-	d.incoming <- Target{ChainInfo: *ci}
+func (d *Dispatcher) enqueue(t Target) error {
+	if d.transform != nil {
+		t.ChainInfo = d.transform(t.ChainInfo)
+	}
+	// Forced targets and the node's own blocks are not peer announcements
+	if t.Reason != EnqueueForced && t.Reason != EnqueueOwnBlock {
+		d.lk.Lock()
+		if d.clock.Since(d.lastAnnouncePrune) >= d.announcementWindow {
+			d.pruneAnnouncements()
+		}
+		d.recordAnnouncement(t)
+		d.lk.Unlock()
+	}
+	d.incoming <- t
 	return nil
 }
 
+// recordAnnouncement records the target's head as its sender's latest
+// announcement.  It must be called with the lock held.
+func (d *Dispatcher) recordAnnouncement(t Target) {
+	if prev, ok := d.announcements[t.Sender]; ok {
+		prevKey := prev.head.String()
+		if d.headPeers[prevKey]--; d.headPeers[prevKey] <= 0 {
+			delete(d.headPeers, prevKey)
+		}
+	}
+	d.headPeers[t.Head.String()]++
+	d.announcements[t.Sender] = announcement{head: t.Head, height: t.Height, receivedAt: d.clock.Now()}
+	d.announceCounts[t.Sender]++
+}
+
 // Start launches the business logic for the syncing subsystem.
 func (d *Dispatcher) Start(syncingCtx context.Context) {
+	if d.pruneInterval > 0 && d.headHeight != nil {
+		go d.pruneStale(syncingCtx)
+	}
+	go d.expireQuarantineEvery(syncingCtx)
 	go func() {
 		defer func() {
 			log.Errorf("exiting")
@@ -162,179 +752,1316 @@ func (d *Dispatcher) Start(syncingCtx context.Context) {
 			default:
 			}
 			catchup, err := d.transitioner.MaybeTransitionToCatchup(d.catchup, ws)
+			var bandHead abi.ChainEpoch
+			var bandHeadErr error
+			if len(d.bands) > 0 && d.headHeight != nil {
+				bandHead, bandHeadErr = d.headHeight()
+				if bandHeadErr != nil {
+					log.Errorf("failed to read head height for priority bands: %s", bandHeadErr)
+				}
+			}
+			d.lk.Lock()
 			if err != nil {
 				log.Errorf("state update error from reading chain head %s", err)
 			} else {
 				d.catchup = catchup
 			}
-			for i, syncTarget := range ws {
-				// Drop targets we don't have room for
-				if d.workQueue.Len() >= d.workQueueSize {
-					log.Infof("not enough space for %d targets on work queue", len(ws)-i)
-					break
-				}
-				// Sort new targets by putting on work queue.
-				d.workQueue.Push(syncTarget)
-			}
-
-			// Check for work to do
-			log.Debugf("processing work queue of %d", d.workQueue.Len())
-			syncTarget, popped := d.workQueue.Pop()
+			d.lk.Unlock()
+			syncTarget, popped := d.receiveAndPop(ws, bandHead, bandHeadErr == nil)
+			d.deliverDepthCrossings()
 			if popped {
 				log.Debugf("processing %v", syncTarget)
 				// Do work
-				err := d.syncer.HandleNewTipSet(syncingCtx, &syncTarget.ChainInfo, d.catchup)
+				timedOut, err := d.handle(syncingCtx, syncTarget)
 				log.Debugf("finished processing %v", syncTarget)
+				d.lk.Lock()
+				d.recordAttempt(syncTarget, err)
+				d.lk.Unlock()
+				if timedOut {
+					syncTimeoutCt.Inc(syncingCtx, 1)
+					dropped := d.requeueTimedOut(&syncTarget)
+					d.deliverDepthCrossings()
+					if dropped {
+						// Complete the target's waiters, it won't be synced
+						d.registeredCb(syncTarget, errors.Errorf("sync of %s dropped after timing out %d times", syncTarget.Head, syncTarget.Retries))
+					}
+					continue
+				}
 				if err != nil {
 					log.Infof("failed sync of %v (catchup=%t): %s", &syncTarget.ChainInfo, d.catchup, err)
 				}
+				d.lk.Lock()
 				d.syncTargetCount++
+				d.inFlight = nil
+				if err == nil && syncTarget.Height > d.syncedHeight {
+					d.syncedHeight, d.syncedHead = syncTarget.Height, syncTarget.Head
+				}
+				d.lk.Unlock()
 				d.registeredCb(syncTarget, err)
-				follow, err := d.transitioner.MaybeTransitionToFollow(syncingCtx, d.catchup, d.workQueue.Len())
+				d.lk.Lock()
+				outstanding := d.workQueue.Len()
+				d.lk.Unlock()
+				follow, err := d.transitioner.MaybeTransitionToFollow(syncingCtx, d.catchup, outstanding)
 				if err != nil {
 					log.Errorf("state update error setting head %s", err)
 				} else {
+					d.lk.Lock()
 					d.catchup = !follow
+					d.lk.Unlock()
 					log.Debugf("catchup state: %v", d.catchup)
 				}
 			} else {
-				// No work left, block until something shows up
+				// No work left or pops paused, block until something
+				// shows up or pops resume
 				log.Debugf("drained work queue, waiting")
 				select {
 				case extra := <-d.incoming:
 					log.Debugf("stopped waiting, received %v", extra)
 					last = &extra
+				case <-d.popsResumed:
+					log.Debugf("stopped waiting, pops resumed")
 				}
 			}
 		}
 	}()
 }
 
-func (d *Dispatcher) drainIncoming() []Target {
-	// drainProduced reads all values within the incoming channel buffer at time
-	// of calling without blocking.  It reads at most incomingBufferSize.
-	//
-	// Note: this relies on a single reader of the incoming channel to
-	// avoid blocking.
-	n := len(d.incoming)
-	produced := make([]Target, n)
-	for i := 0; i < n; i++ {
-		produced[i] = <-d.incoming
+// receiveAndPop queues the received targets and pops the next target to
+// sync, marking it in flight.  Policy callbacks run under the lock, so it is
+// released by a deferred unlock in case one of them panics.
+func (d *Dispatcher) receiveAndPop(ws []Target, bandHead abi.ChainEpoch, bandHeadOK bool) (Target, bool) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	for _, syncTarget := range ws {
+		d.receive(syncTarget)
 	}
-	return produced
+	d.expireQuarantine()
+	d.maybeLogDuplicates()
+
+	// Check for work to do
+	log.Debugf("processing work queue of %d", d.workQueue.Len())
+	var syncTarget Target
+	popped := false
+	if len(d.bands) > 0 || d.peerLatency != nil || d.tieStrategy == TieMostPeers {
+		// Bands move with the chain head, latencies with the
+		// network and peer counts with announcements
+		if len(d.bands) > 0 && d.headHeight != nil && bandHeadOK {
+			d.bandHead, d.bandHeadOK = bandHead, true
+		}
+		if d.tieStrategy == TieMostPeers {
+			d.pruneAnnouncements()
+		}
+		d.workQueue.requestReorder()
+	}
+	if !d.popsPaused {
+		syncTarget, popped = d.popUnexpired()
+	}
+	if popped {
+		d.inFlight = &syncTarget
+	}
+	d.observeDepth()
+	return syncTarget, popped
 }
 
-// RegisterCallback registers a callback on the dispatcher that
-// will fire after every successful target sync.
-func (d *Dispatcher) RegisterCallback(cb func(Target, error)) {
-	d.control <- cbMessage{cb: cb}
+// requeueTimedOut requeues a target whose sync timed out, or drops it once
+// it has timed out more than the maximum retries.  It returns true if the
+// target was dropped.
+func (d *Dispatcher) requeueTimedOut(t *Target) bool {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	// Clear inFlight before t changes, State reports the target as popped
+	d.inFlight = nil
+	t.Retries++
+	dropped := t.Retries > d.maxSyncRetries
+	if dropped {
+		log.Infof("sync of %v timed out after %s, dropping it after %d retries", &t.ChainInfo, d.syncDeadline, d.maxSyncRetries)
+		d.recordDrop(*t, DropReasonRetries)
+	} else {
+		log.Infof("sync of %v timed out after %s, requeueing", &t.ChainInfo, d.syncDeadline)
+		d.admit(*t)
+	}
+	d.observeDepth()
+	return dropped
 }
 
-// WaiterForTarget returns a function that will block until the dispatcher
-// processes the given target and returns the error produced by that targer
-func (d *Dispatcher) WaiterForTarget(waitKey block.TipSetKey) func() error {
-	processed := moresync.NewLatch(1)
-	var syncErr error
-	d.RegisterCallback(func(t Target, err error) {
-		if t.ChainInfo.Head.Equals(waitKey) {
-			syncErr = err
-			processed.Done()
+// receive admits a received target to the work queue, unless the queue is
+// full or the target is taken into quarantine.  It must be called with the
+// lock held.
+func (d *Dispatcher) receive(t Target) {
+	if !t.forced {
+		if d.workQueue.Len() >= d.workQueueSize {
+			log.Debugf("no space for target %v on work queue", &t.ChainInfo)
+			d.recordDrop(t, DropReasonFull)
+			return
+		}
+		if d.quarantined(t) {
+			return
 		}
-	})
-	return func() error {
-		processed.Wait()
-		return syncErr
 	}
+	d.admit(t)
 }
-func (d *Dispatcher) processCtrl(ctrlMsg interface{}) {
-	// processCtrl takes a control message, determines its type, and performs the
-	// specified action.
-	//
-	// Using interfaces is overkill for now but is the way to make this
-	// extensible.  (Delete this comment if we add more than one control)
-	switch typedMsg := ctrlMsg.(type) {
-	case cbMessage:
-		d.registeredCb = typedMsg.cb
-	default:
-		// We don't know this type, log and ignore
-		log.Info("dispatcher control can not handle type %T", typedMsg)
+
+// admit puts a target on the work queue if it passes the admission checks:
+// there must be room for it, gossip may not use the reserved capacity and it
+// may not be subsumed or a duplicate.  Forced targets make room for
+// themselves.  Targets failing a check are recorded as dropped.  It returns
+// true if the target was queued.  It must be called with the lock held.
+func (d *Dispatcher) admit(t Target) bool {
+	if d.workQueue.Len() >= d.workQueueSize {
+		if !t.forced {
+			log.Debugf("no space for target %v on work queue", &t.ChainInfo)
+			d.recordDrop(t, DropReasonFull)
+			return false
+		}
+		d.makeRoomForForced(t)
 	}
+	if t.Reason == EnqueueGossip && d.queuedGossip() >= d.gossipCapacity {
+		log.Debugf("no unreserved space for gossip target %v", &t.ChainInfo)
+		d.recordDrop(t, DropReasonFull)
+		return false
+	}
+	if !d.subsume(t) {
+		log.Debugf("target %v subsumed by a queued descendant", &t.ChainInfo)
+		d.recordDrop(t, DropReasonSubsumed)
+		return false
+	}
+	// Sort new targets by putting on work queue.
+	if !d.workQueue.Push(t) {
+		d.recordDrop(t, DropReasonDuplicate)
+		return false
+	}
+	return true
 }
 
-// Target tracks a logical request of the syncing subsystem to run a
-// syncing job against given inputs.
-type Target struct {
-	block.ChainInfo
+// makeRoomForForced evicts the lowest priority queued target that is neither
+// forced nor watched to make room for a forced target.  Nothing is evicted if
+// the forced head is already queued, as it replaces its queued entry.  If
+// every queued target is forced or watched the forced target exceeds the
+// work queue size.  It must be called with the lock held.
+func (d *Dispatcher) makeRoomForForced(t Target) {
+	if _, queued := d.workQueue.targetSet[d.workQueue.dedupKey(t.ChainInfo)]; queued {
+		return
+	}
+	evicted, ok := d.workQueue.lowest(func(queued Target) bool {
+		_, watched := d.watched[queued.Height]
+		return !queued.forced && !watched
+	})
+	if !ok {
+		log.Infof("work queue full of forced and watched targets, queueing forced target %v beyond its size", &t.ChainInfo)
+		return
+	}
+	evictedKey := d.workQueue.dedupKey(evicted.ChainInfo)
+	d.workQueue.removeWhere(func(queued Target) bool {
+		return d.workQueue.dedupKey(queued.ChainInfo) == evictedKey
+	})
+	log.Debugf("evicted target %v to make room for forced target %v", &evicted.ChainInfo, &t.ChainInfo)
+	d.recordDrop(evicted, DropReasonFull)
 }
 
-// Transitioner determines whether the caller should move between catchup and
-// follow states.
-type Transitioner interface {
-	MaybeTransitionToCatchup(bool, []Target) (bool, error)
-	MaybeTransitionToFollow(context.Context, bool, int) (bool, error)
-	TransitionChannel() chan bool
+// quarantined is a target sent only by suspect peers.
+type quarantined struct {
+	target Target
+	since  time.Time
 }
 
-// GapTransitioner changes state based on the detection of gaps between the
-// local head and syncing targets.
-type GapTransitioner struct {
-	// headState is used to determine the head tipset height for switching
-	// measuring gaps.
-	headState chainHeadState
-	// headSetter sets the chain head to the internal staged value.
-	headSetter transitionSyncer
-	// transitionCh emits true when transitioning to catchup and false
-	// when transitioning to follow
-	transitionCh chan bool
+// FlagSuspect marks a peer as a possible Sybil.  Its targets are quarantined
+// until a peer that isn't suspect sends the same target, and dropped if none
+// does within the quarantine window or the quarantine is full.
+func (d *Dispatcher) FlagSuspect(p peer.ID) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.suspects[p] = struct{}{}
 }
 
-// NewGapTransitioner returns a new gap transitioner
-func NewGapTransitioner(headState chainHeadState, headSetter transitionSyncer) *GapTransitioner {
-	return &GapTransitioner{
-		headState:    headState,
-		headSetter:   headSetter,
-		transitionCh: make(chan bool, 0),
+// Quarantined returns the targets waiting for corroboration.
+func (d *Dispatcher) Quarantined() []Target {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	targets := make([]Target, 0, len(d.quarantine))
+	for _, q := range d.quarantine {
+		targets = append(targets, q.target)
 	}
+	return targets
 }
 
-// MaybeTransitionToCatchup returns true if the state is already catchup, or if
-// it should transition from follow to catchup. Undefined on error.
-func (gt *GapTransitioner) MaybeTransitionToCatchup(inCatchup bool, targets []Target) (bool, error) {
-	if inCatchup {
-		return true, nil
+// quarantined returns true if a received target was taken into quarantine
+// rather than left for the work queue.  Targets from other peers corroborate
+// and release the quarantined target with the same dedup key.  It must be
+// called with the lock held.
+func (d *Dispatcher) quarantined(t Target) bool {
+	key := d.workQueue.dedupKey(t.ChainInfo)
+	if _, suspect := d.suspects[t.Sender]; !suspect {
+		if _, ok := d.quarantine[key]; ok {
+			log.Debugf("target %v corroborated by %s", &t.ChainInfo, t.Sender)
+			d.release(key)
+		}
+		return false
 	}
-	// current head height
-	head, err := gt.headState.GetTipSet(gt.headState.GetHead())
-	if err != nil {
-		return false, err
+	if _, queued := d.workQueue.targetSet[key]; queued {
+		return false
 	}
-	headHeight, err := head.Height()
-	if err != nil {
-		return false, err
+	if _, ok := d.quarantine[key]; ok {
+		d.recordDrop(t, DropReasonDuplicate)
+		return true
+	}
+	if len(d.quarantine) >= d.quarantineSize || d.quarantinedBy[t.Sender] >= d.quarantinePerSuspect {
+		log.Debugf("no space in quarantine for target %v from suspect peer %s", &t.ChainInfo, t.Sender)
+		d.recordDrop(t, DropReasonQuarantineFull)
+		return true
+	}
+	log.Debugf("quarantining target %v from suspect peer %s", &t.ChainInfo, t.Sender)
+	d.quarantine[key] = quarantined{target: t, since: d.clock.Now()}
+	d.quarantinedBy[t.Sender]++
+	select {
+	case d.quarantineSet <- struct{}{}:
+	default:
 	}
+	return true
+}
 
-	// transition from follow to catchup if incoming targets have gaps
-	// Note: we run this check even on targets we may drop
-	for _, target := range targets {
-		if target.Height > headHeight+MaxEpochGap {
-			gt.transitionCh <- true
-			return true, nil
-		}
+// release removes a target from quarantine.  It must be called with the lock
+// held.
+func (d *Dispatcher) release(key string) {
+	q := d.quarantine[key]
+	delete(d.quarantine, key)
+	if d.quarantinedBy[q.target.Sender]--; d.quarantinedBy[q.target.Sender] <= 0 {
+		delete(d.quarantinedBy, q.target.Sender)
 	}
-	return false, nil
 }
 
-// MaybeTransitionToFollow returns true if the state is already follow, or if
-// it should transition from catchup to follow.  Undefined on error.
-func (gt *GapTransitioner) MaybeTransitionToFollow(ctx context.Context, inCatchup bool, outstandingTargets int) (bool, error) {
-	if !inCatchup {
-		return true, nil
+// expireQuarantine drops the quarantined targets no peer corroborated within
+// the quarantine window.  It must be called with the lock held.
+func (d *Dispatcher) expireQuarantine() {
+	for key, q := range d.quarantine {
+		if d.clock.Since(q.since) < d.quarantineWindow {
+			continue
+		}
+		log.Debugf("dropping uncorroborated target %v", &q.target.ChainInfo)
+		d.release(key)
+		d.recordDrop(q.target, DropReasonUncorroborated)
 	}
+}
 
-	// transition from catchup to follow if the work queue is empty.
-	// this is safe -- all gap conditions cause syncing to enter catchup
-	// this is pessimistic -- gap conditions could be gone before we transition
-	if outstandingTargets == 0 {
+// expireQuarantineEvery expires quarantined targets as their windows end,
+// so they are dropped on time even while a long sync blocks the worker.  It
+// only waits on the clock while targets are quarantined.
+func (d *Dispatcher) expireQuarantineEvery(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.quarantineSet:
+		}
+		for {
+			d.lk.Lock()
+			d.expireQuarantine()
+			var next time.Duration
+			for _, q := range d.quarantine {
+				if left := d.quarantineWindow - d.clock.Since(q.since); next == 0 || left < next {
+					next = left
+				}
+			}
+			empty := len(d.quarantine) == 0
+			d.lk.Unlock()
+			if empty {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.clock.After(next):
+			}
+		}
+	}
+}
+
+// subsume applies target subsumption to a target about to be queued.  It
+// returns false if the target should be dropped because a queued target
+// descends from it.  Otherwise queued targets it descends from are removed.
+// Forced and watched targets are never subsumed.  Oracle errors are logged
+// and treated as unknown ancestry.  It must be called with the lock held.
+func (d *Dispatcher) subsume(t Target) bool {
+	subsumed := make(map[string]struct{})
+	_, watched := d.watched[t.Height]
+	for _, queued := range d.workQueue.q.targets {
+		if !t.forced && !watched {
+			descends, err := d.ancestry.DescendsFrom(queued.Head, t.Head)
+			if err != nil {
+				log.Warnf("failed to check whether %s descends from %s: %s", queued.Head, t.Head, err)
+			} else if descends {
+				return false
+			}
+		}
+		if _, queuedWatched := d.watched[queued.Height]; queued.forced || queuedWatched {
+			continue
+		}
+		ancestor, err := d.ancestry.IsAncestor(queued.Head, t.Head)
+		if err != nil {
+			log.Warnf("failed to check whether %s is an ancestor of %s: %s", queued.Head, t.Head, err)
+		} else if ancestor {
+			subsumed[d.workQueue.dedupKey(queued.ChainInfo)] = struct{}{}
+		}
+	}
+	if len(subsumed) == 0 {
+		return true
+	}
+	removed := d.workQueue.removeWhere(func(queued Target) bool {
+		_, ok := subsumed[d.workQueue.dedupKey(queued.ChainInfo)]
+		return ok
+	})
+	for _, r := range removed {
+		log.Debugf("queued target %v subsumed by %v", &r.ChainInfo, &t.ChainInfo)
+		d.recordDrop(r, DropReasonSubsumed)
+	}
+	return true
+}
+
+// depthCrossing is a crossing of a work queue depth threshold.
+type depthCrossing struct {
+	threshold int
+	up        bool
+}
+
+// observeDepth observes the work queue's depth and queues the thresholds
+// crossed since the last observation for delivery.  It must be called with
+// the lock held.
+func (d *Dispatcher) observeDepth() {
+	depth := d.workQueue.Len()
+	for _, threshold := range d.depthThresholds {
+		switch {
+		case d.lastDepth < threshold && depth >= threshold:
+			d.pendingCrossings = append(d.pendingCrossings, depthCrossing{threshold: threshold, up: true})
+		case d.lastDepth >= threshold && depth < threshold:
+			d.pendingCrossings = append(d.pendingCrossings, depthCrossing{threshold: threshold, up: false})
+		}
+	}
+	d.lastDepth = depth
+}
+
+// deliverDepthCrossings reports the observed crossings to the depth threshold
+// callback in the order they were observed.  Only one caller delivers at a
+// time; crossings observed meanwhile are delivered by that caller.  It must
+// be called without the lock held.
+func (d *Dispatcher) deliverDepthCrossings() {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.deliveringCrossings {
+		return
+	}
+	d.deliveringCrossings = true
+	defer func() { d.deliveringCrossings = false }()
+	for len(d.pendingCrossings) > 0 {
+		crossed := d.pendingCrossings
+		d.pendingCrossings = nil
+		// Re-lock even if the callback panics, the deferred unlock
+		// expects the lock held
+		func() {
+			d.lk.Unlock()
+			defer d.lk.Lock()
+			for _, c := range crossed {
+				d.onDepthThreshold(c.threshold, c.up)
+			}
+		}()
+	}
+}
+
+// queuedGossip returns the number of gossip targets on the work queue.
+func (d *Dispatcher) queuedGossip() int {
+	n := 0
+	for _, t := range d.workQueue.q.targets {
+		if t.Reason == EnqueueGossip {
+			n++
+		}
+	}
+	return n
+}
+
+// popUnexpired pops the best target that has not expired, dropping the
+// expired targets popped before it.  It must be called with the lock held.
+func (d *Dispatcher) popUnexpired() (Target, bool) {
+	for {
+		t, ok := d.workQueue.Pop()
+		if !ok || t.expiry.IsZero() || d.clock.Now().Before(t.expiry) {
+			return t, ok
+		}
+		log.Debugf("dropping target %v expired at %s", &t.ChainInfo, t.expiry)
+		d.recordDrop(t, DropReasonExpired)
+	}
+}
+
+// handle syncs a target, cancelling the sync if it runs past the sync
+// deadline.  It returns true if the sync was cancelled for running late.
+func (d *Dispatcher) handle(ctx context.Context, t Target) (bool, error) {
+	if d.syncDeadline <= 0 {
+		return false, d.syncer.HandleNewTipSet(ctx, &t.ChainInfo, d.catchup)
+	}
+	syncCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	expired := make(chan struct{})
+	timer := d.clock.AfterFunc(d.syncDeadline, func() {
+		close(expired)
+		cancel()
+	})
+	err := d.syncer.HandleNewTipSet(syncCtx, &t.ChainInfo, d.catchup)
+	timer.Stop()
+	select {
+	case <-expired:
+		return err != nil, err
+	default:
+		return false, err
+	}
+}
+
+// pruneStale removes queued targets below the chain head every prune
+// interval until the context is done.
+func (d *Dispatcher) pruneStale(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.clock.After(d.pruneInterval):
+		}
+		headHeight, err := d.headHeight()
+		if err != nil {
+			log.Errorf("failed to read head height for pruning: %s", err)
+			continue
+		}
+		pruned := d.pruneBelow(headHeight)
+		d.deliverDepthCrossings()
+		if len(pruned) == 0 {
+			continue
+		}
+		log.Debugf("pruned %d targets below head height %d", len(pruned), headHeight)
+		if d.onEvict != nil {
+			for _, t := range pruned {
+				d.onEvict(t)
+			}
+		}
+	}
+}
+
+// pruneBelow drops the queued targets below headHeight that are neither
+// watched nor forced and returns them.
+func (d *Dispatcher) pruneBelow(headHeight abi.ChainEpoch) []Target {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	pruned := d.workQueue.removeWhere(func(t Target) bool {
+		_, watched := d.watched[t.Height]
+		return t.Height < headHeight && !watched && !t.forced
+	})
+	for _, t := range pruned {
+		d.recordDrop(t, DropReasonStale)
+	}
+	d.observeDepth()
+	return pruned
+}
+
+// maybeLogDuplicates logs the sample of dropped duplicate targets once per
+// sampling interval.
+func (d *Dispatcher) maybeLogDuplicates() {
+	if d.clock.Since(d.dupWindowStart) < d.dupInterval {
+		return
+	}
+	sample, seen := d.dupSample.drain()
+	if seen > 0 {
+		log.Infof("dropped %d duplicate targets in the last %s, sample: %v", seen, d.dupInterval, sample)
+	}
+	d.dupWindowStart = d.clock.Now()
+}
+
+func (d *Dispatcher) drainIncoming() []Target {
+	// drainProduced reads all values within the incoming channel buffer at time
+	// of calling without blocking.  It reads at most incomingBufferSize.
+	//
+	// Note: this relies on a single reader of the incoming channel to
+	// avoid blocking.
+	n := len(d.incoming)
+	produced := make([]Target, n)
+	for i := 0; i < n; i++ {
+		produced[i] = <-d.incoming
+	}
+	return produced
+}
+
+// PausePops stops the dispatcher from starting new syncs.  Received targets
+// are still queued.  A sync already running is not interrupted.
+func (d *Dispatcher) PausePops() {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.popsPaused = true
+}
+
+// ResumePops lets the dispatcher start syncing queued targets again after
+// PausePops.
+func (d *Dispatcher) ResumePops() {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.popsPaused = false
+	select {
+	case d.popsResumed <- struct{}{}:
+	default:
+	}
+}
+
+// WatchHeights adds heights to the watch list.  Targets at watched heights
+// are synced before all other targets except forced ones, and are never
+// pruned as stale.  This lets operators debugging a fork keep the targets at
+// its heights in front.
+func (d *Dispatcher) WatchHeights(hs ...abi.ChainEpoch) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	for _, h := range hs {
+		d.watched[h] = struct{}{}
+	}
+	d.workQueue.requestReorder()
+}
+
+// byWatched is a comparator preferring targets at watched heights.  It must
+// be called with the lock held.
+func (d *Dispatcher) byWatched(a, b Target) int {
+	_, wa := d.watched[a.Height]
+	_, wb := d.watched[b.Height]
+	switch {
+	case wa && !wb:
+		return -1
+	case !wa && wb:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// CancelRange removes all queued and quarantined targets with heights in the
+// inclusive range [min, max] and returns the number of targets removed.
+// Targets already being synced are not affected.
+func (d *Dispatcher) CancelRange(min, max abi.ChainEpoch) int {
+	cancelled := d.cancelRange(min, max)
+	d.deliverDepthCrossings()
+	return cancelled
+}
+
+// cancelRange removes the queued and quarantined targets with heights in
+// [min, max] and returns how many it removed.
+func (d *Dispatcher) cancelRange(min, max abi.ChainEpoch) int {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	cancelled := d.workQueue.removeWhere(func(t Target) bool {
+		return t.Height >= min && t.Height <= max
+	})
+	for _, t := range cancelled {
+		d.attempts.remove(t.Head.String())
+	}
+	n := len(cancelled)
+	for key, q := range d.quarantine {
+		if q.target.Height >= min && q.target.Height <= max {
+			d.release(key)
+			n++
+		}
+	}
+	d.observeDepth()
+	return n
+}
+
+// SyncClass classifies a target by how far it is above the chain head.
+// Workers use it to choose a syncing strategy.
+type SyncClass int
+
+const (
+	// SyncClassUnknown is returned when the chain head height is unknown.
+	SyncClassUnknown SyncClass = iota
+	// SyncClassTip marks targets at or just above the chain head.
+	SyncClassTip
+	// SyncClassShallow marks targets a few epochs above the chain head.
+	SyncClassShallow
+	// SyncClassDeep marks targets far above the chain head.
+	SyncClassDeep
+)
+
+// Classify returns the sync class of a target given the current chain head.
+// It requires the WithHeadHeight option and returns SyncClassUnknown if the
+// head height can't be read.
+func (d *Dispatcher) Classify(t *Target) SyncClass {
+	if d.headHeight == nil {
+		return SyncClassUnknown
+	}
+	headHeight, err := d.headHeight()
+	if err != nil {
+		log.Errorf("failed to read head height for classification: %s", err)
+		return SyncClassUnknown
+	}
+	gap := t.Height - headHeight
+	switch {
+	case gap <= d.tipGap:
+		return SyncClassTip
+	case gap <= d.deepGap:
+		return SyncClassShallow
+	default:
+		return SyncClassDeep
+	}
+}
+
+// PrimaryTarget returns the queued target the dispatcher will sync next, for
+// display as the node's primary sync target.  Unlike popping, reading the
+// primary target does not consume it.  The second return value is false if
+// the queue is empty.
+func (d *Dispatcher) PrimaryTarget() (*Target, bool) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	t, ok := d.workQueue.Peek()
+	if !ok {
+		return nil, false
+	}
+	return &t, true
+}
+
+// BestAsCheckpoint returns the head and height of the best known target for
+// use as a fast-sync checkpoint, letting a light client fetch a snapshot at
+// it instead of syncing every tipset up to it.  The best known target is the
+// in-flight target or the queue top, whichever the queue orders first.  The
+// final return value is false if no target is in flight or queued.
+func (d *Dispatcher) BestAsCheckpoint() (block.TipSetKey, abi.ChainEpoch, bool) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	best, ok := d.bestTarget()
+	if !ok {
+		return block.TipSetKey{}, 0, false
+	}
+	return best.Head, best.Height, true
+}
+
+// AgreementRatio returns the fraction of recently announcing peers whose
+// latest announcement is the head of the best known target, the in-flight
+// target or the queue top, whichever the queue orders first.  A low ratio
+// signals a contentious fork.  It returns 0 if no target is in flight or
+// queued, or no peer announced within the announcement window.
+func (d *Dispatcher) AgreementRatio() float64 {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	best, ok := d.bestTarget()
+	if !ok {
+		return 0
+	}
+	d.pruneAnnouncements()
+	if len(d.announcements) == 0 {
+		return 0
+	}
+	return float64(d.headPeers[best.Head.String()]) / float64(len(d.announcements))
+}
+
+// bestTarget returns the in-flight target or the queue top, whichever the
+// queue orders first.  It must be called with the lock held.
+func (d *Dispatcher) bestTarget() (Target, bool) {
+	top, ok := d.workQueue.Peek()
+	if d.inFlight == nil || (ok && d.workQueue.q.less(top, *d.inFlight)) {
+		return top, ok
+	}
+	return *d.inFlight, true
+}
+
+// MarginalBenefit returns the number of epochs of progress syncing a target
+// would add beyond the best of the successfully synced targets, the in-flight
+// target and, given the WithHeadHeight option, the chain head.  Targets with
+// no benefit are covered by work already done or underway.  With an ancestry
+// oracle, the synced and in-flight targets only cover targets they descend
+// from, so forks at or below them keep their benefit.  Otherwise, and for the
+// chain head, which is known only by height, targets are compared by height.
+// Oracle errors are treated as unknown ancestry.
+func (d *Dispatcher) MarginalBenefit(t *Target) abi.ChainEpoch {
+	d.lk.Lock()
+	_, noAncestry := d.ancestry.(noopAncestryOracle)
+	var covers []block.ChainInfo
+	if !d.syncedHead.Empty() {
+		covers = append(covers, block.ChainInfo{Head: d.syncedHead, Height: d.syncedHeight})
+	}
+	if d.inFlight != nil {
+		covers = append(covers, d.inFlight.ChainInfo)
+	}
+	d.lk.Unlock()
+	var best abi.ChainEpoch
+	for _, c := range covers {
+		if c.Height <= best {
+			continue
+		}
+		if noAncestry || c.Head.Equals(t.Head) {
+			best = c.Height
+			continue
+		}
+		descends, err := d.ancestry.DescendsFrom(c.Head, t.Head)
+		if err != nil {
+			log.Warnf("failed to check whether %s descends from %s: %s", c.Head, t.Head, err)
+		} else if descends {
+			best = c.Height
+		}
+	}
+	if d.headHeight != nil {
+		if head, err := d.headHeight(); err == nil && head > best {
+			best = head
+		}
+	}
+	if t.Height <= best {
+		return 0
+	}
+	return t.Height - best
+}
+
+// BestKnownHead summarizes where the network is.  It returns the head most
+// peers announced last within the announcement window, its height and the
+// number of peers announcing it.  Ties go to the greater height, then to the
+// smaller head.  The count is 0 if no peer announced within the window.
+func (d *Dispatcher) BestKnownHead() (block.TipSetKey, abi.ChainEpoch, int) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	type candidate struct {
+		head   block.TipSetKey
+		height abi.ChainEpoch
+		peers  int
+	}
+	d.pruneAnnouncements()
+	candidates := make(map[string]*candidate)
+	for _, a := range d.announcements {
+		key := a.head.String()
+		if c, ok := candidates[key]; ok {
+			c.peers++
+			continue
+		}
+		candidates[key] = &candidate{head: a.head, height: a.height, peers: 1}
+	}
+	var best *candidate
+	for key, c := range candidates {
+		switch {
+		case best == nil,
+			c.peers > best.peers,
+			c.peers == best.peers && c.height > best.height,
+			c.peers == best.peers && c.height == best.height && key < best.head.String():
+			best = c
+		}
+	}
+	if best == nil {
+		return block.TipSetKey{}, 0, 0
+	}
+	return best.head, best.height, best.peers
+}
+
+// PeerActivity returns the cumulative number of announcements received from
+// each sending peer.
+func (d *Dispatcher) PeerActivity() map[peer.ID]uint64 {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	activity := make(map[peer.ID]uint64, len(d.announceCounts))
+	for p, count := range d.announceCounts {
+		activity[p] = count
+	}
+	return activity
+}
+
+// Attempt is a failed attempt to sync a head from a peer.
+type Attempt struct {
+	// Peer is the peer the head's blocks were requested from.
+	Peer peer.ID
+	Err  error
+	At   time.Time
+}
+
+// AttemptLog returns the failed attempts to sync a head, oldest first.
+// Repeated failures from the same peer point to a peer advertising heads it
+// can't serve.  The log of a head is cleared once it syncs or its target is
+// dropped.  Only the latest AttemptLogSize attempts of the AttemptLogHeads
+// most recently failed heads are retained.
+func (d *Dispatcher) AttemptLog(key block.TipSetKey) []Attempt {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.attempts.get(key.String())
+}
+
+// recordAttempt records the outcome of syncing a target.  It must be called
+// with the lock held.
+func (d *Dispatcher) recordAttempt(t Target, err error) {
+	key := t.Head.String()
+	if err == nil {
+		d.attempts.remove(key)
+		return
+	}
+	d.attempts.add(key, Attempt{Peer: t.Peer(), Err: err, At: d.clock.Now()})
+}
+
+// attemptLogs holds the attempt logs of a bounded number of heads, evicting
+// the least recently failed head when full.
+type attemptLogs struct {
+	size  int
+	order *list.List
+	logs  map[string]*list.Element
+}
+
+// headAttempts is the attempt log of one head.
+type headAttempts struct {
+	key      string
+	attempts []Attempt
+}
+
+func newAttemptLogs(size int) *attemptLogs {
+	return &attemptLogs{
+		size:  size,
+		order: list.New(),
+		logs:  make(map[string]*list.Element),
+	}
+}
+
+func (al *attemptLogs) get(key string) []Attempt {
+	e, ok := al.logs[key]
+	if !ok {
+		return []Attempt{}
+	}
+	return append([]Attempt{}, e.Value.(*headAttempts).attempts...)
+}
+
+func (al *attemptLogs) add(key string, a Attempt) {
+	e, ok := al.logs[key]
+	if ok {
+		al.order.MoveToFront(e)
+	} else {
+		e = al.order.PushFront(&headAttempts{key: key})
+		al.logs[key] = e
+		if al.order.Len() > al.size {
+			al.remove(al.order.Back().Value.(*headAttempts).key)
+		}
+	}
+	ha := e.Value.(*headAttempts)
+	ha.attempts = append(ha.attempts, a)
+	if len(ha.attempts) > AttemptLogSize {
+		ha.attempts = ha.attempts[len(ha.attempts)-AttemptLogSize:]
+	}
+}
+
+func (al *attemptLogs) remove(key string) {
+	if e, ok := al.logs[key]; ok {
+		al.order.Remove(e)
+		delete(al.logs, key)
+	}
+}
+
+// DroppedTarget is a target the dispatcher dropped, why and when.
+type DroppedTarget struct {
+	Target
+	Reason    string
+	DroppedAt time.Time
+}
+
+// RecentDrops returns the most recently dropped targets, oldest first.
+func (d *Dispatcher) RecentDrops() []DroppedTarget {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.recentDrops.list()
+}
+
+// recordDrop accounts for a dropped target.  Callers must hold lk.
+func (d *Dispatcher) recordDrop(t Target, reason string) {
+	d.dropCounts[reason]++
+	d.recentDrops.add(DroppedTarget{Target: t, Reason: reason, DroppedAt: d.clock.Now()})
+	if reason == DropReasonDuplicate {
+		d.dupSample.offer(t)
+	}
+	// Keep the attempt log of a head dropped while still queued, such as a
+	// duplicate.
+	if _, queued := d.workQueue.targetSet[d.workQueue.dedupKey(t.ChainInfo)]; !queued {
+		d.attempts.remove(t.Head.String())
+	}
+}
+
+// dropRing is a ring buffer retaining the latest dropped targets.
+type dropRing struct {
+	drops []DroppedTarget
+	// next is the index the next drop is written to.
+	next int
+	full bool
+}
+
+// newDropRing returns a ring retaining the latest size drops.  A negative
+// size is treated as 0.
+func newDropRing(size int) *dropRing {
+	if size < 0 {
+		size = 0
+	}
+	return &dropRing{drops: make([]DroppedTarget, size)}
+}
+
+func (r *dropRing) add(dt DroppedTarget) {
+	if len(r.drops) == 0 {
+		return
+	}
+	r.drops[r.next] = dt
+	r.next = (r.next + 1) % len(r.drops)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the retained drops, oldest first.
+func (r *dropRing) list() []DroppedTarget {
+	if !r.full {
+		return append([]DroppedTarget{}, r.drops[:r.next]...)
+	}
+	return append(append([]DroppedTarget{}, r.drops[r.next:]...), r.drops[:r.next]...)
+}
+
+// DropReasons returns the cumulative number of targets the dispatcher has
+// dropped, keyed by the reason they were dropped.
+func (d *Dispatcher) DropReasons() map[string]uint64 {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	reasons := make(map[string]uint64, len(d.dropCounts))
+	for reason, count := range d.dropCounts {
+		reasons[reason] = count
+	}
+	return reasons
+}
+
+// DispatcherState is a snapshot of the dispatcher's state for offline
+// analysis.
+type DispatcherState struct {
+	// Queue holds the queued targets in the order they would be synced.
+	Queue []TargetState
+	// InFlight is the target being synced, if any.
+	InFlight        *TargetState
+	Catchup         bool
+	WorkQueueSize   int
+	SyncTargetCount uint64
+	DropReasons     map[string]uint64
+	Policies        PolicyState
+	// Suspects are the peers flagged as possible Sybils, base58 encoded and
+	// sorted.
+	Suspects []string
+	// Quarantined holds the targets waiting for corroboration, by
+	// decreasing height.
+	Quarantined []TargetState
+}
+
+// TargetState is the serializable form of a sync target.  Peer IDs are
+// base58 encoded.
+type TargetState struct {
+	Head    block.TipSetKey
+	Height  abi.ChainEpoch
+	Source  string
+	Sender  string
+	Reason  EnqueueReason
+	Retries int
+	// Forced targets are synced first, by decreasing Priority.
+	Forced   bool
+	Priority int
+	// Expiry is when the target is dropped if still queued, zero if never.
+	Expiry time.Time
+}
+
+// PolicyState records which of the dispatcher's optional policies are
+// configured and how.
+type PolicyState struct {
+	Comparators             int
+	Urgency                 bool
+	Transform               bool
+	Scored                  bool
+	DedupKey                bool
+	Ancestry                bool
+	PeerLatency             bool
+	Bands                   []PriorityBand
+	TieStrategy             TieStrategy
+	ReservedFraction        float64
+	ReorderInterval         time.Duration
+	PruneInterval           time.Duration
+	SyncDeadline            time.Duration
+	MaxSyncRetries          int
+	DepthThresholds         []int
+	QuarantineWindow        time.Duration
+	QuarantinePerSuspect    int
+	QuarantineSize          int
+	DuplicateSampleSize     int
+	DuplicateSampleInterval time.Duration
+	// WatchedHeights are the heights prioritized by WatchHeights, sorted.
+	WatchedHeights []abi.ChainEpoch
+}
+
+func newTargetState(t Target) TargetState {
+	return TargetState{
+		Head:   t.Head,
+		Height: t.Height,
+		Source: peer.IDB58Encode(t.Source),
+		Sender: peer.IDB58Encode(t.Sender),
+		Reason: t.Reason,
+
+		Retries:  t.Retries,
+		Forced:   t.forced,
+		Priority: t.priority,
+		Expiry:   t.expiry,
+	}
+}
+
+// State returns an atomic snapshot of the dispatcher's state.
+func (d *Dispatcher) State() DispatcherState {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	_, noAncestry := d.ancestry.(noopAncestryOracle)
+	st := DispatcherState{
+		Queue:           make([]TargetState, 0, d.workQueue.Len()),
+		Catchup:         d.catchup,
+		WorkQueueSize:   d.workQueueSize,
+		SyncTargetCount: d.syncTargetCount,
+		DropReasons:     make(map[string]uint64, len(d.dropCounts)),
+		Policies: PolicyState{
+			Comparators:             len(d.comparators),
+			Urgency:                 d.urgency != nil,
+			Transform:               d.transform != nil,
+			Scored:                  d.scorer != nil,
+			DedupKey:                d.dedupKey != nil,
+			Ancestry:                !noAncestry,
+			PeerLatency:             d.peerLatency != nil,
+			Bands:                   append([]PriorityBand{}, d.bands...),
+			TieStrategy:             d.tieStrategy,
+			ReservedFraction:        d.reservedFraction,
+			ReorderInterval:         d.reorderInterval,
+			PruneInterval:           d.pruneInterval,
+			SyncDeadline:            d.syncDeadline,
+			MaxSyncRetries:          d.maxSyncRetries,
+			DepthThresholds:         append([]int{}, d.depthThresholds...),
+			QuarantineWindow:        d.quarantineWindow,
+			QuarantinePerSuspect:    d.quarantinePerSuspect,
+			QuarantineSize:          d.quarantineSize,
+			DuplicateSampleSize:     d.dupSample.size,
+			DuplicateSampleInterval: d.dupInterval,
+			WatchedHeights:          make([]abi.ChainEpoch, 0, len(d.watched)),
+		},
+		Suspects:    make([]string, 0, len(d.suspects)),
+		Quarantined: make([]TargetState, 0, len(d.quarantine)),
+	}
+	for h := range d.watched {
+		st.Policies.WatchedHeights = append(st.Policies.WatchedHeights, h)
+	}
+	sort.Slice(st.Policies.WatchedHeights, func(i, j int) bool {
+		return st.Policies.WatchedHeights[i] < st.Policies.WatchedHeights[j]
+	})
+	for p := range d.suspects {
+		st.Suspects = append(st.Suspects, peer.IDB58Encode(p))
+	}
+	sort.Strings(st.Suspects)
+	for _, q := range d.quarantine {
+		st.Quarantined = append(st.Quarantined, newTargetState(q.target))
+	}
+	sort.Slice(st.Quarantined, func(i, j int) bool {
+		if st.Quarantined[i].Height != st.Quarantined[j].Height {
+			return st.Quarantined[i].Height > st.Quarantined[j].Height
+		}
+		return st.Quarantined[i].Head.String() < st.Quarantined[j].Head.String()
+	})
+	d.workQueue.Ordered(func(t Target) bool {
+		st.Queue = append(st.Queue, newTargetState(t))
+		return true
+	})
+	if d.inFlight != nil {
+		inFlight := newTargetState(*d.inFlight)
+		st.InFlight = &inFlight
+	}
+	for reason, count := range d.dropCounts {
+		st.DropReasons[reason] = count
+	}
+	return st
+}
+
+// DumpJSON writes an atomic snapshot of the dispatcher's state to w as JSON,
+// for attaching to bug reports.
+func (d *Dispatcher) DumpJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(d.State())
+}
+
+// ordered returns the queued targets in pop order.
+func (d *Dispatcher) ordered() []Target {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	var targets []Target
+	d.workQueue.Ordered(func(t Target) bool {
+		targets = append(targets, t)
+		return true
+	})
+	return targets
+}
+
+// GraphDOT writes the queued targets to w as a Graphviz DOT digraph for
+// visualizing the fork landscape.  Targets are nodes, in pop order, labeled
+// with their head and height.  An edge runs from each target to every queued
+// target the oracle reports as its descendant.  A nil oracle uses the
+// dispatcher's own.
+func (d *Dispatcher) GraphDOT(w io.Writer, oracle AncestryOracle) error {
+	if oracle == nil {
+		oracle = d.ancestry
+	}
+	targets := d.ordered()
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph targets {\n")
+	for i, t := range targets {
+		fmt.Fprintf(&buf, "\tt%d [label=%q];\n", i, fmt.Sprintf("%s\nheight %d", t.Head, t.Height))
+	}
+	for i, a := range targets {
+		for j, b := range targets {
+			if i == j {
+				continue
+			}
+			ancestor, err := oracle.IsAncestor(a.Head, b.Head)
+			if err != nil {
+				return errors.Wrapf(err, "failed to check whether %s is an ancestor of %s", a.Head, b.Head)
+			}
+			if ancestor {
+				fmt.Fprintf(&buf, "\tt%d -> t%d;\n", i, j)
+			}
+		}
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// RegisterCallback registers a callback on the dispatcher that
+// will fire after every successful target sync.
+func (d *Dispatcher) RegisterCallback(cb func(Target, error)) {
+	d.control <- cbMessage{cb: cb}
+}
+
+// WaiterForTarget returns a function that will block until the dispatcher
+// processes the given target and returns the error produced by that targer
+func (d *Dispatcher) WaiterForTarget(waitKey block.TipSetKey) func() error {
+	processed := moresync.NewLatch(1)
+	var syncErr error
+	d.RegisterCallback(func(t Target, err error) {
+		if t.ChainInfo.Head.Equals(waitKey) {
+			syncErr = err
+			processed.Done()
+		}
+	})
+	return func() error {
+		processed.Wait()
+		return syncErr
+	}
+}
+func (d *Dispatcher) processCtrl(ctrlMsg interface{}) {
+	// processCtrl takes a control message, determines its type, and performs the
+	// specified action.
+	//
+	// Using interfaces is overkill for now but is the way to make this
+	// extensible.  (Delete this comment if we add more than one control)
+	switch typedMsg := ctrlMsg.(type) {
+	case cbMessage:
+		d.registeredCb = typedMsg.cb
+	default:
+		// We don't know this type, log and ignore
+		log.Info("dispatcher control can not handle type %T", typedMsg)
+	}
+}
+
+// Target tracks a logical request of the syncing subsystem to run a
+// syncing job against given inputs.
+type Target struct {
+	block.ChainInfo
+	// Reason records why the target was sent to the dispatcher.
+	Reason EnqueueReason
+	// Retries counts the syncs of this target cancelled for running past
+	// the sync deadline.
+	Retries int
+
+	// score is the memoized priority of the target in a scored queue.
+	score int64
+	// forced targets are synced before all others, by decreasing priority.
+	forced   bool
+	priority int
+	// expiry, if set, is when the target stops being worth syncing.
+	expiry time.Time
+}
+
+// EnqueueReason is the reason a target was sent to the dispatcher.
+type EnqueueReason string
+
+const (
+	// EnqueueBootstrap marks targets from bootstrap peers' hello messages.
+	EnqueueBootstrap = EnqueueReason("bootstrap")
+	// EnqueueGossip marks targets from blocks received over pubsub.
+	EnqueueGossip = EnqueueReason("gossip")
+	// EnqueueOwnBlock marks targets from the node's own mining.
+	EnqueueOwnBlock = EnqueueReason("own")
+	// EnqueueForced marks targets forced by an operator.
+	EnqueueForced = EnqueueReason("forced")
+	// EnqueueExpiring marks targets received with a sender-provided expiry.
+	EnqueueExpiring = EnqueueReason("expiring")
+)
+
+// Peer returns the peer that sent us this target.  This is the peer that
+// should be asked for the target's blocks.
+func (t Target) Peer() peer.ID {
+	return t.Sender
+}
+
+// Transitioner determines whether the caller should move between catchup and
+// follow states.
+type Transitioner interface {
+	MaybeTransitionToCatchup(bool, []Target) (bool, error)
+	MaybeTransitionToFollow(context.Context, bool, int) (bool, error)
+	TransitionChannel() chan bool
+}
+
+// GapTransitioner changes state based on the detection of gaps between the
+// local head and syncing targets.
+type GapTransitioner struct {
+	// headState is used to determine the head tipset height for switching
+	// measuring gaps.
+	headState chainHeadState
+	// headSetter sets the chain head to the internal staged value.
+	headSetter transitionSyncer
+	// transitionCh emits true when transitioning to catchup and false
+	// when transitioning to follow
+	transitionCh chan bool
+}
+
+// NewGapTransitioner returns a new gap transitioner
+func NewGapTransitioner(headState chainHeadState, headSetter transitionSyncer) *GapTransitioner {
+	return &GapTransitioner{
+		headState:    headState,
+		headSetter:   headSetter,
+		transitionCh: make(chan bool, 0),
+	}
+}
+
+// MaybeTransitionToCatchup returns true if the state is already catchup, or if
+// it should transition from follow to catchup. Undefined on error.
+func (gt *GapTransitioner) MaybeTransitionToCatchup(inCatchup bool, targets []Target) (bool, error) {
+	if inCatchup {
+		return true, nil
+	}
+	// current head height
+	head, err := gt.headState.GetTipSet(gt.headState.GetHead())
+	if err != nil {
+		return false, err
+	}
+	headHeight, err := head.Height()
+	if err != nil {
+		return false, err
+	}
+
+	// transition from follow to catchup if incoming targets have gaps
+	// Note: we run this check even on targets we may drop
+	for _, target := range targets {
+		if target.Height > headHeight+MaxEpochGap {
+			gt.transitionCh <- true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MaybeTransitionToFollow returns true if the state is already follow, or if
+// it should transition from catchup to follow.  Undefined on error.
+func (gt *GapTransitioner) MaybeTransitionToFollow(ctx context.Context, inCatchup bool, outstandingTargets int) (bool, error) {
+	if !inCatchup {
+		return true, nil
+	}
+
+	// transition from catchup to follow if the work queue is empty.
+	// this is safe -- all gap conditions cause syncing to enter catchup
+	// this is pessimistic -- gap conditions could be gone before we transition
+	if outstandingTargets == 0 {
 		gt.transitionCh <- false
 		// set staging to head on transition catchup --> follow
 		return true, gt.headSetter.SetStagedHead(ctx)
@@ -352,34 +2079,90 @@ func (gt *GapTransitioner) TransitionChannel() chan bool {
 // prioritization policy.
 //
 // It also filters the `targetQueue` so that it always contains targets with
-// unique chain heads.
+// unique dedup keys, by default their chain heads.
 //
 // It wraps the `targetQueue` to prevent panics during
 // normal operation.
 type TargetQueue struct {
 	q         targetQueue
 	targetSet map[string]struct{}
+	// dedupKey returns the key targets are deduplicated on.
+	dedupKey func(block.ChainInfo) string
+	// scorer, if set, computes the memoized score of pushed targets.
+	scorer Scorer
+
+	// reorderInterval, if positive, is the minimum time between heap
+	// re-initializations of a queue with unordered pushes.
+	reorderInterval time.Duration
+	reorderClock    clock.Clock
+	lastReorder     time.Time
+	// unordered is true if targets were pushed since the heap was last
+	// ordered.
+	unordered bool
 }
 
-// NewTargetQueue returns a new target queue.
-func NewTargetQueue() *TargetQueue {
-	rq := make(targetQueue, 0)
+// NewTargetQueue returns a new target queue ordered by the given comparators.
+// Each comparator is consulted in turn until one returns a non-zero result.
+// With no comparators targets are ordered by claimed chain height.
+func NewTargetQueue(cmps ...Comparator) *TargetQueue {
+	byHeightOnly := len(cmps) == 0
+	if byHeightOnly {
+		cmps = []Comparator{ByHeight}
+	}
+	rq := targetQueue{
+		targets:      make([]Target, 0),
+		cmp:          chainComparators(cmps),
+		byHeightOnly: byHeightOnly,
+	}
 	heap.Init(&rq)
 	return &TargetQueue{
 		q:         rq,
 		targetSet: make(map[string]struct{}),
+		dedupKey:  headKey,
 	}
 }
 
-// Push adds a sync target to the target queue.
-func (tq *TargetQueue) Push(t Target) {
-	// If already in queue drop quickly
-	if _, inQ := tq.targetSet[t.ChainInfo.Head.String()]; inQ {
-		return
+// headKey is the default dedup key, the string form of the chain head.
+func headKey(ci block.ChainInfo) string {
+	return ci.Head.String()
+}
+
+// NewScoredTargetQueue returns a new target queue ordering targets by score,
+// highest first.  Each target is scored once when it is pushed and the score
+// is reused by every subsequent heap operation.  Re-pushing a target
+// recomputes its score.
+func NewScoredTargetQueue(score Scorer) *TargetQueue {
+	tq := NewTargetQueue(byMemoizedScore)
+	tq.scorer = score
+	return tq
+}
+
+// Push adds a sync target to the target queue.  It returns false if the
+// target was dropped because a target with the same dedup key is already
+// queued.  A forced target replaces the queued one instead.
+func (tq *TargetQueue) Push(t Target) bool {
+	key := tq.dedupKey(t.ChainInfo)
+	if _, inQ := tq.targetSet[key]; inQ {
+		// If already in queue drop quickly
+		if !t.forced {
+			return false
+		}
+		tq.removeWhere(func(queued Target) bool {
+			return tq.dedupKey(queued.ChainInfo) == key
+		})
+	}
+	if tq.scorer != nil {
+		t.score = tq.scorer(t)
+	}
+	if tq.reorderInterval > 0 {
+		tq.q.Push(t)
+		tq.unordered = true
+		tq.maybeReorder()
+	} else {
+		heap.Push(&tq.q, t)
 	}
-	heap.Push(&tq.q, t)
-	tq.targetSet[t.ChainInfo.Head.String()] = struct{}{}
-	return
+	tq.targetSet[tq.dedupKey(t.ChainInfo)] = struct{}{}
+	return true
 }
 
 // Pop removes and returns the highest priority syncing target. If there is
@@ -388,46 +2171,491 @@ func (tq *TargetQueue) Pop() (Target, bool) {
 	if tq.Len() == 0 {
 		return Target{}, false
 	}
-	req := heap.Pop(&tq.q).(Target)
-	popKey := req.ChainInfo.Head.String()
+	tq.maybeReorder()
+	var req Target
+	if tq.unordered {
+		// Take the best target, as Peek does, leaving the rest unordered
+		last := tq.Len() - 1
+		tq.q.Swap(tq.bestUnordered(), last)
+		req = tq.q.targets[last]
+		tq.q.targets = tq.q.targets[:last]
+	} else {
+		req = heap.Pop(&tq.q).(Target)
+	}
+	popKey := tq.dedupKey(req.ChainInfo)
 	delete(tq.targetSet, popKey)
 	return req, true
 }
 
+// PopDecider names what ordered a popped target ahead of the next one.
+type PopDecider string
+
+const (
+	// DecidedAlone marks a target popped from a queue holding no other.
+	DecidedAlone = PopDecider("alone")
+	// DecidedForced marks a target ahead by forced priority.
+	DecidedForced = PopDecider("forced")
+	// DecidedHeight marks a target ahead by the default height ordering.
+	DecidedHeight = PopDecider("height")
+	// DecidedPolicy marks a target ahead by the queue's comparators or
+	// scorer.
+	DecidedPolicy = PopDecider("policy")
+	// DecidedRetries marks a target ahead because the next target's syncs
+	// ran past the sync deadline more often.
+	DecidedRetries = PopDecider("retries")
+	// DecidedTie marks a target the queue had no preference for over the
+	// next one.
+	DecidedTie = PopDecider("tie")
+)
+
+// PopResult is a popped target along with why it was selected.
+type PopResult struct {
+	Target
+	// Score is the target's memoized score, zero outside of scored queues.
+	Score int64
+	// Decider is what ordered the target ahead of the next queued target.
+	Decider PopDecider
+	// PoliciesApplied is true if the target was selected by something other
+	// than the default height ordering.
+	PoliciesApplied bool
+}
+
+// PopResult pops the highest priority syncing target like Pop, along with
+// the context of its selection.  If there is nothing in the queue the second
+// argument returns false.
+func (tq *TargetQueue) PopResult() (PopResult, bool) {
+	t, ok := tq.Pop()
+	if !ok {
+		return PopResult{}, false
+	}
+	res := PopResult{Target: t, Score: t.score, Decider: DecidedAlone}
+	if next, ok := tq.Peek(); ok {
+		res.Decider = tq.q.decider(t, next)
+	}
+	switch res.Decider {
+	case DecidedForced, DecidedRetries, DecidedPolicy:
+		res.PoliciesApplied = true
+	}
+	return res, true
+}
+
+// Peek returns the highest priority syncing target without removing it. If
+// there is nothing in the queue the second argument returns false.  Peeking
+// or popping a queue with pushes awaiting a batched reorder scans every
+// target.
+func (tq *TargetQueue) Peek() (Target, bool) {
+	if tq.Len() == 0 {
+		return Target{}, false
+	}
+	if !tq.unordered {
+		return tq.q.targets[0], true
+	}
+	return tq.q.targets[tq.bestUnordered()], true
+}
+
+// bestUnordered returns the index of the best target of a non-empty queue
+// with pushes awaiting a batched reorder, by scanning every target.
+func (tq *TargetQueue) bestUnordered() int {
+	best := 0
+	for i := 1; i < tq.Len(); i++ {
+		if tq.q.less(tq.q.targets[i], tq.q.targets[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// reorder restores the queue's order after a change to state its comparators
+// depend on.
+func (tq *TargetQueue) reorder() {
+	heap.Init(&tq.q)
+	tq.unordered = false
+}
+
+// requestReorder restores the queue's order like reorder.  Under a reorder
+// interval the queue is instead left unordered until the interval elapses.
+func (tq *TargetQueue) requestReorder() {
+	if tq.reorderInterval <= 0 {
+		tq.reorder()
+		return
+	}
+	tq.unordered = true
+	tq.maybeReorder()
+}
+
+// SetReorderInterval bounds the cost of ordering bursts of pushes.  Once set,
+// pushed targets are appended without restoring heap order, and the heap is
+// re-initialized at most once per interval as measured on c, including after
+// removals and changes to comparator state.  Order is restored by the first
+// push or pop after the interval elapses.  Within an interval Peek and Pop
+// scan for the best target instead.  A zero interval restores per-push
+// ordering.
+func (tq *TargetQueue) SetReorderInterval(c clock.Clock, interval time.Duration) {
+	tq.reorderClock = c
+	tq.reorderInterval = interval
+	if tq.unordered {
+		tq.reorder()
+	}
+}
+
+// maybeReorder re-initializes an unordered heap if the reorder interval has
+// elapsed since it was last ordered.
+func (tq *TargetQueue) maybeReorder() {
+	if !tq.unordered || tq.reorderClock.Since(tq.lastReorder) < tq.reorderInterval {
+		return
+	}
+	tq.reorder()
+	tq.lastReorder = tq.reorderClock.Now()
+}
+
 // Len returns the number of targets in the queue.
 func (tq *TargetQueue) Len() int {
 	return tq.q.Len()
 }
 
+// Ordered calls yield on each queued target in the order they would be
+// popped, stopping early if yield returns false.  The queue is not modified.
+func (tq *TargetQueue) Ordered(yield func(Target) bool) {
+	walk := tq.q
+	walk.targets = append([]Target{}, tq.q.targets...)
+	if tq.unordered {
+		heap.Init(&walk)
+	}
+	for walk.Len() > 0 {
+		if !yield(heap.Pop(&walk).(Target)) {
+			return
+		}
+	}
+}
+
+// Heights returns the distinct heights of the queued targets in ascending
+// order.  Compared against the current head it shows gaps in the heights
+// being tracked.
+func (tq *TargetQueue) Heights() []abi.ChainEpoch {
+	seen := make(map[abi.ChainEpoch]struct{}, tq.Len())
+	heights := make([]abi.ChainEpoch, 0, tq.Len())
+	for _, t := range tq.q.targets {
+		if _, ok := seen[t.Height]; ok {
+			continue
+		}
+		seen[t.Height] = struct{}{}
+		heights = append(heights, t.Height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// SiblingGroups returns the queued heads competing at the same height, one
+// group per contested height.  Chain infos do not carry parents, so heads
+// claiming the same height are treated as siblings.  Groups and the heads
+// within them follow pop order, and heights with a single queued head are
+// omitted.
+func (tq *TargetQueue) SiblingGroups() [][]block.TipSetKey {
+	var heights []abi.ChainEpoch
+	byHeight := make(map[abi.ChainEpoch][]block.TipSetKey)
+	tq.Ordered(func(t Target) bool {
+		if _, ok := byHeight[t.Height]; !ok {
+			heights = append(heights, t.Height)
+		}
+		byHeight[t.Height] = append(byHeight[t.Height], t.Head)
+		return true
+	})
+	var groups [][]block.TipSetKey
+	for _, h := range heights {
+		if len(byHeight[h]) > 1 {
+			groups = append(groups, byHeight[h])
+		}
+	}
+	return groups
+}
+
+// removeWhere removes all targets matching the predicate from the queue and
+// returns them.
+func (tq *TargetQueue) removeWhere(remove func(Target) bool) []Target {
+	kept := tq.q.targets[:0]
+	var removed []Target
+	for _, t := range tq.q.targets {
+		if remove(t) {
+			delete(tq.targetSet, tq.dedupKey(t.ChainInfo))
+			removed = append(removed, t)
+			continue
+		}
+		kept = append(kept, t)
+	}
+	tq.q.targets = kept
+	if len(removed) > 0 {
+		tq.requestReorder()
+	}
+	return removed
+}
+
+// lowest returns the queued target matching the predicate that would be
+// popped last.
+func (tq *TargetQueue) lowest(match func(Target) bool) (Target, bool) {
+	var low Target
+	found := false
+	for _, t := range tq.q.targets {
+		if !match(t) {
+			continue
+		}
+		if !found || tq.q.less(low, t) {
+			low = t
+			found = true
+		}
+	}
+	return low, found
+}
+
+// Comparator orders two sync targets.  It returns -1 if a should be synced
+// before b, 1 if b should be synced before a and 0 if it has no preference.
+type Comparator func(a, b Target) int
+
+// ByHeight is a comparator preferring targets with a higher claimed chain
+// height.
+func ByHeight(a, b Target) int {
+	switch {
+	case a.Height > b.Height:
+		return -1
+	case a.Height < b.Height:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Scorer computes a numeric priority for a target.  Targets with higher
+// scores are synced first.
+type Scorer func(Target) int64
+
+// byMemoizedScore is a comparator preferring targets with a higher memoized
+// score.
+func byMemoizedScore(a, b Target) int {
+	switch {
+	case a.score > b.score:
+		return -1
+	case a.score < b.score:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// byForcedPriority is a comparator preferring forced targets over organic
+// ones and forced targets with a higher priority over lower ones.
+func byForcedPriority(a, b Target) int {
+	switch {
+	case a.forced && !b.forced:
+		return -1
+	case !a.forced && b.forced:
+		return 1
+	case a.priority > b.priority:
+		return -1
+	case a.priority < b.priority:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// byFewerRetries is a comparator demoting targets whose syncs ran past the
+// sync deadline more often.
+func byFewerRetries(a, b Target) int {
+	switch {
+	case a.Retries < b.Retries:
+		return -1
+	case a.Retries > b.Retries:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// PriorityBand assigns a priority to targets at most MaxDistance epochs from
+// the chain head.
+type PriorityBand struct {
+	MaxDistance abi.ChainEpoch
+	Priority    int
+}
+
+// bandHeadHeight returns the chain head height snapshot targets are banded
+// against, and false if the head height has not been read yet.  It must be
+// called with the lock held.
+func (d *Dispatcher) bandHeadHeight() (abi.ChainEpoch, bool) {
+	return d.bandHead, d.bandHeadOK
+}
+
+// byBand returns a comparator preferring targets in higher priority bands.
+// It has no preference if the head height is not known.
+func byBand(bands []PriorityBand, headHeight func() (abi.ChainEpoch, bool)) Comparator {
+	bandPriority := func(h, head abi.ChainEpoch) int {
+		distance := h - head
+		if distance < 0 {
+			distance = -distance
+		}
+		for _, band := range bands {
+			if distance <= band.MaxDistance {
+				return band.Priority
+			}
+		}
+		return 0
+	}
+	return func(a, b Target) int {
+		head, ok := headHeight()
+		if !ok {
+			return 0
+		}
+		pa, pb := bandPriority(a.Height, head), bandPriority(b.Height, head)
+		switch {
+		case pa > pb:
+			return -1
+		case pa < pb:
+			return 1
+		default:
+			return 0
+		}
+	}
+}
+
+// TieStrategy is how the dispatcher picks between distinct targets its
+// ordering can't separate, such as competing forks at the same height.
+type TieStrategy int
+
+const (
+	// TieArbitrary leaves ties to the work queue, the default.
+	TieArbitrary TieStrategy = iota
+	// TieMostPeers prefers the head most peers last announced, breaking
+	// ties in peer count by the smaller head.
+	TieMostPeers
+	// TieSmallestHead prefers the lexicographically smaller head.
+	TieSmallestHead
+)
+
+// byMostPeers is a comparator preferring heads last announced by more peers.
+// It must be called with the lock held.
+func (d *Dispatcher) byMostPeers(a, b Target) int {
+	pa, pb := d.headPeers[a.Head.String()], d.headPeers[b.Head.String()]
+	switch {
+	case pa > pb:
+		return -1
+	case pa < pb:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// bySmallestHead is a comparator preferring the lexicographically smaller
+// head.
+func bySmallestHead(a, b Target) int {
+	return strings.Compare(a.Head.String(), b.Head.String())
+}
+
+// byPeerLatency returns a comparator preferring targets whose sender has the
+// lower latency.
+func byPeerLatency(latency func(peer.ID) time.Duration) Comparator {
+	return func(a, b Target) int {
+		la, lb := latency(a.Sender), latency(b.Sender)
+		switch {
+		case la < lb:
+			return -1
+		case la > lb:
+			return 1
+		default:
+			return 0
+		}
+	}
+}
+
+// byUrgency returns a comparator preferring targets with a higher urgency.
+func byUrgency(urgency func(block.ChainInfo) int) Comparator {
+	return func(a, b Target) int {
+		ua, ub := urgency(a.ChainInfo), urgency(b.ChainInfo)
+		switch {
+		case ua > ub:
+			return -1
+		case ua < ub:
+			return 1
+		default:
+			return 0
+		}
+	}
+}
+
+// chainComparators returns a comparator consulting each of cmps in order
+// until one of them is decisive.
+func chainComparators(cmps []Comparator) Comparator {
+	return func(a, b Target) int {
+		for _, cmp := range cmps {
+			if c := cmp(a, b); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+}
+
 // targetQueue orders targets by a policy.
 //
-// The current simple policy is to order syncing requests by claimed chain
-// height.
+// Forced targets come first, by decreasing priority, then targets with fewer
+// sync retries.  Otherwise the policy is a comparator, by default ordering
+// syncing requests by claimed chain height.
 //
 // `targetQueue` can panic so it shouldn't be used unwrapped
-type targetQueue []Target
+type targetQueue struct {
+	targets []Target
+	cmp     Comparator
+	// byHeightOnly is true if cmp is the default height ordering.
+	byHeightOnly bool
+}
 
 // Heavily inspired by https://golang.org/pkg/container/heap/
-func (rq targetQueue) Len() int { return len(rq) }
+func (rq *targetQueue) Len() int { return len(rq.targets) }
+
+func (rq *targetQueue) Less(i, j int) bool {
+	return rq.less(rq.targets[i], rq.targets[j])
+}
 
-func (rq targetQueue) Less(i, j int) bool {
-	// We want Pop to give us the highest priority so we use greater than
-	return rq[i].Height > rq[j].Height
+// less reports whether a is popped before b.
+func (rq *targetQueue) less(a, b Target) bool {
+	if c := byForcedPriority(a, b); c != 0 {
+		return c < 0
+	}
+	if c := byFewerRetries(a, b); c != 0 {
+		return c < 0
+	}
+	return rq.cmp(a, b) < 0
+}
+
+// decider returns what orders a ahead of b, following Less.
+func (rq *targetQueue) decider(a, b Target) PopDecider {
+	if byForcedPriority(a, b) != 0 {
+		return DecidedForced
+	}
+	if byFewerRetries(a, b) != 0 {
+		return DecidedRetries
+	}
+	if rq.cmp(a, b) != 0 {
+		if rq.byHeightOnly {
+			return DecidedHeight
+		}
+		return DecidedPolicy
+	}
+	return DecidedTie
 }
 
-func (rq targetQueue) Swap(i, j int) {
-	rq[i], rq[j] = rq[j], rq[i]
+func (rq *targetQueue) Swap(i, j int) {
+	rq.targets[i], rq.targets[j] = rq.targets[j], rq.targets[i]
 }
 
 func (rq *targetQueue) Push(x interface{}) {
 	syncReq := x.(Target)
-	*rq = append(*rq, syncReq)
+	rq.targets = append(rq.targets, syncReq)
 }
 
 func (rq *targetQueue) Pop() interface{} {
-	old := *rq
+	old := rq.targets
 	n := len(old)
 	item := old[n-1]
-	*rq = old[0 : n-1]
+	rq.targets = old[0 : n-1]
 	return item
 }
@@ -1,14 +1,22 @@
 package dispatcher_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/filecoin-project/go-filecoin/internal/pkg/block"
 	"github.com/filecoin-project/go-filecoin/internal/pkg/chainsync/internal/dispatcher"
+	"github.com/filecoin-project/go-filecoin/internal/pkg/clock"
 	"github.com/filecoin-project/go-filecoin/internal/pkg/types"
 	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -37,79 +45,1941 @@ func (fs *mockSyncer) HandleNewTipSet(_ context.Context, ci *block.ChainInfo, _
 	return nil
 }
 
+// blockingSyncer blocks its first call to HandleNewTipSet until released.
+// Targets sent before Start remain on the work queue while it is blocked.
+type blockingSyncer struct {
+	started chan struct{}
+	release chan struct{}
+
+	lk          sync.Mutex
+	headsCalled []block.TipSetKey
+}
+
+func newBlockingSyncer() *blockingSyncer {
+	return &blockingSyncer{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (bs *blockingSyncer) HandleNewTipSet(_ context.Context, ci *block.ChainInfo, _ bool) error {
+	bs.lk.Lock()
+	bs.headsCalled = append(bs.headsCalled, ci.Head)
+	first := len(bs.headsCalled) == 1
+	bs.lk.Unlock()
+	if first {
+		close(bs.started)
+		<-bs.release
+	}
+	return nil
+}
+
+func (bs *blockingSyncer) heads() []block.TipSetKey {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	return append([]block.TipSetKey{}, bs.headsCalled...)
+}
+
+// fakeAncestry is an ancestry oracle knowing the ancestors of a few heads,
+// keyed by the string form of the descendant.
+type fakeAncestry struct {
+	ancestors map[string][]block.TipSetKey
+}
+
+func (fa *fakeAncestry) IsAncestor(ancestor, descendant block.TipSetKey) (bool, error) {
+	for _, a := range fa.ancestors[descendant.String()] {
+		if a.Equals(ancestor) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (fa *fakeAncestry) DescendsFrom(descendant, ancestor block.TipSetKey) (bool, error) {
+	return fa.IsAncestor(ancestor, descendant)
+}
+
+// failingSyncer fails to sync heads from peers in failFrom.
+type failingSyncer struct {
+	failFrom map[peer.ID]struct{}
+}
+
+func (fs *failingSyncer) HandleNewTipSet(_ context.Context, ci *block.ChainInfo, _ bool) error {
+	if _, ok := fs.failFrom[ci.Sender]; ok {
+		return fmt.Errorf("%s can't serve %s", ci.Sender, ci.Head)
+	}
+	return nil
+}
+
+// hangingSyncer hangs on its first call to HandleNewTipSet until the sync is
+// cancelled.  Later calls succeed immediately.
+type hangingSyncer struct {
+	lk          sync.Mutex
+	headsCalled []block.TipSetKey
+}
+
+func (hs *hangingSyncer) HandleNewTipSet(ctx context.Context, ci *block.ChainInfo, _ bool) error {
+	hs.lk.Lock()
+	hs.headsCalled = append(hs.headsCalled, ci.Head)
+	first := len(hs.headsCalled) == 1
+	hs.lk.Unlock()
+	if first {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
 func TestDispatchStartHappy(t *testing.T) {
 	tf.UnitTest(t)
-	s := &mockSyncer{
-		headsCalled: make([]block.TipSetKey, 0),
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcher(s, nt)
+
+	cis := []*block.ChainInfo{
+		// We need to put these in priority order to avoid a race.
+		// If we send 0 before 42, it is possible the dispatcher will
+		// pick up 0 and start processing before it sees 42.
+		chainInfoFromHeight(t, 42),
+		chainInfoFromHeight(t, 16),
+		chainInfoFromHeight(t, 3),
+		chainInfoFromHeight(t, 2),
+		chainInfoFromHeight(t, 0),
+	}
+
+	testDispatch.Start(context.Background())
+
+	// set up a blocking channel and register to unblock after 5 synced
+	allDone := moresync.NewLatch(5)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+
+	// receive requests before Start() to test deterministic order
+	go func() {
+		for _, ci := range cis {
+			assert.NoError(t, testDispatch.SendHello(ci))
+		}
+	}()
+	allDone.Wait()
+
+	// check that the mockSyncer synced in order
+	require.Equal(t, 5, len(s.headsCalled))
+	for i := range cis {
+		assert.Equal(t, cis[i].Head, s.headsCalled[i])
+	}
+}
+
+func TestDispatcherDropsWhenFull(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	testWorkSize := 20
+	testBufferSize := 30
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, testWorkSize, testBufferSize)
+
+	finished := moresync.NewLatch(1)
+	testDispatch.RegisterCallback(func(target dispatcher.Target, _ error) {
+		// Fail if the work that should be dropped gets processed
+		assert.False(t, target.Height == 100)
+		assert.False(t, target.Height == 101)
+		assert.False(t, target.Height == 102)
+		if target.Height == 0 {
+			// 0 has lowest priority of non-dropped
+			finished.Done()
+		}
+	})
+	for j := 0; j < testWorkSize; j++ {
+		ci := chainInfoFromHeight(t, j)
+		assert.NoError(t, testDispatch.SendHello(ci))
+	}
+	// Should be dropped
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 100)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 101)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 102)))
+
+	testDispatch.Start(context.Background())
+
+	finished.Wait()
+}
+
+func TestDispatcherUsesComparators(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	lowestFirst := func(a, b dispatcher.Target) int {
+		return dispatcher.ByHeight(b, a)
+	}
+	testDispatch := dispatcher.NewDispatcher(s, nt, dispatcher.WithComparators([]dispatcher.Comparator{lowestFirst}))
+
+	cis := []*block.ChainInfo{
+		chainInfoFromHeight(t, 3),
+		chainInfoFromHeight(t, 1),
+		chainInfoFromHeight(t, 2),
+	}
+	allDone := moresync.NewLatch(uint(len(cis)))
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	// send everything before Start so all targets are queued together
+	for _, ci := range cis {
+		assert.NoError(t, testDispatch.SendHello(ci))
+	}
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	require.Equal(t, 3, len(s.headsCalled))
+	assert.Equal(t, cis[1].Head, s.headsCalled[0])
+	assert.Equal(t, cis[2].Head, s.headsCalled[1])
+	assert.Equal(t, cis[0].Head, s.headsCalled[2])
+}
+
+func TestDispatcherUrgency(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	urgent := chainInfoFromHeight(t, 5)
+	urgency := func(ci block.ChainInfo) int {
+		if ci.Head.Equals(urgent.Head) {
+			return 1
+		}
+		return 0
+	}
+	testDispatch := dispatcher.NewDispatcher(s, nt, dispatcher.WithUrgency(urgency))
+
+	cis := []*block.ChainInfo{
+		chainInfoFromHeight(t, 20),
+		urgent,
+		chainInfoFromHeight(t, 3),
+	}
+	allDone := moresync.NewLatch(uint(len(cis)))
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	for _, ci := range cis {
+		assert.NoError(t, testDispatch.SendHello(ci))
+	}
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	// the urgent target beats the taller one, the rest go by height
+	require.Equal(t, 3, len(s.headsCalled))
+	assert.Equal(t, urgent.Head, s.headsCalled[0])
+	assert.Equal(t, cis[0].Head, s.headsCalled[1])
+	assert.Equal(t, cis[2].Head, s.headsCalled[2])
+}
+
+func TestDispatcherRecordsEnqueueReason(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcher(s, nt)
+
+	hello := chainInfoFromHeight(t, 3)
+	own := chainInfoFromHeight(t, 2)
+	gossip := chainInfoFromHeight(t, 1)
+	reasons := make(map[string]dispatcher.EnqueueReason)
+	allDone := moresync.NewLatch(3)
+	testDispatch.RegisterCallback(func(target dispatcher.Target, _ error) {
+		reasons[target.Head.String()] = target.Reason
+		allDone.Done()
+	})
+	assert.NoError(t, testDispatch.SendHello(hello))
+	assert.NoError(t, testDispatch.SendOwnBlock(own))
+	assert.NoError(t, testDispatch.SendGossipBlock(gossip))
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	assert.Equal(t, map[string]dispatcher.EnqueueReason{
+		hello.Head.String():  dispatcher.EnqueueBootstrap,
+		own.Head.String():    dispatcher.EnqueueOwnBlock,
+		gossip.Head.String(): dispatcher.EnqueueGossip,
+	}, reasons)
+}
+
+func TestDispatcherTransform(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	raise := func(ci block.ChainInfo) block.ChainInfo {
+		ci.Height += 100
+		return ci
+	}
+	testDispatch := dispatcher.NewDispatcher(s, nt, dispatcher.WithTransform(raise))
+
+	var synced dispatcher.Target
+	finished := moresync.NewLatch(1)
+	testDispatch.RegisterCallback(func(target dispatcher.Target, _ error) {
+		synced = target
+		finished.Done()
+	})
+	ci := chainInfoFromHeight(t, 7)
+	assert.NoError(t, testDispatch.SendGossipBlock(ci))
+	testDispatch.Start(context.Background())
+	finished.Wait()
+
+	assert.Equal(t, ci.Head, synced.Head)
+	assert.Equal(t, abi.ChainEpoch(107), synced.Height)
+	// the caller's chain info is not modified
+	assert.Equal(t, abi.ChainEpoch(7), ci.Height)
+}
+
+func TestDispatcherDedupKey(t *testing.T) {
+	tf.UnitTest(t)
+	siblingA := chainInfoFromHeightAndSeed(t, 5, "a")
+	siblingB := chainInfoFromHeightAndSeed(t, 5, "b")
+	other := chainInfoFromHeight(t, 4)
+	parents := map[string]string{
+		siblingA.Head.String(): "p",
+		siblingB.Head.String(): "p",
+		other.Head.String():    "q",
+	}
+	byParent := func(ci block.ChainInfo) string {
+		return parents[ci.Head.String()]
+	}
+
+	syncAll := func(opts ...dispatcher.DispatcherOption) (*mockSyncer, *dispatcher.Dispatcher) {
+		s := &mockSyncer{
+			headsCalled: make([]block.TipSetKey, 0),
+		}
+		testDispatch := dispatcher.NewDispatcher(s, &noopTransitioner{}, opts...)
+		assert.NoError(t, testDispatch.SendGossipBlock(siblingA))
+		assert.NoError(t, testDispatch.SendGossipBlock(siblingB))
+		assert.NoError(t, testDispatch.SendGossipBlock(other))
+		// All three arrive together, so once "other", the lowest target,
+		// is synced everything queued has been synced.
+		finished := moresync.NewLatch(1)
+		testDispatch.RegisterCallback(func(target dispatcher.Target, _ error) {
+			if target.Head.Equals(other.Head) {
+				finished.Done()
+			}
+		})
+		testDispatch.Start(context.Background())
+		finished.Wait()
+		return s, testDispatch
+	}
+
+	// the default key keeps distinct heads apart
+	s, testDispatch := syncAll()
+	assert.Equal(t, 3, len(s.headsCalled))
+	assert.Equal(t, uint64(0), testDispatch.DropReasons()[dispatcher.DropReasonDuplicate])
+
+	// keying on the parent collapses the siblings
+	s, testDispatch = syncAll(dispatcher.WithDedupKey(byParent))
+	require.Equal(t, 2, len(s.headsCalled))
+	assert.Equal(t, siblingA.Head, s.headsCalled[0])
+	assert.Equal(t, other.Head, s.headsCalled[1])
+	assert.Equal(t, uint64(1), testDispatch.DropReasons()[dispatcher.DropReasonDuplicate])
+}
+
+func TestDispatcherForceTarget(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+
+	high := chainInfoFromHeight(t, 50)
+	mid := chainInfoFromHeight(t, 40)
+	forcedLow := chainInfoFromHeight(t, 2)
+	forcedLower := chainInfoFromHeight(t, 1)
+	var reasons []dispatcher.EnqueueReason
+	allDone := moresync.NewLatch(4)
+	testDispatch.RegisterCallback(func(target dispatcher.Target, _ error) {
+		reasons = append(reasons, target.Reason)
+		allDone.Done()
+	})
+	assert.NoError(t, testDispatch.SendGossipBlock(high))
+	assert.NoError(t, testDispatch.SendGossipBlock(mid))
+	assert.NoError(t, testDispatch.SendGossipBlock(forcedLower))
+	assert.NoError(t, testDispatch.ForceTarget(*forcedLow, 1))
+	// forcing an already queued head raises it to the forced tier
+	assert.NoError(t, testDispatch.ForceTarget(*forcedLower, 2))
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	require.Equal(t, 4, len(s.headsCalled))
+	assert.Equal(t, forcedLower.Head, s.headsCalled[0])
+	assert.Equal(t, forcedLow.Head, s.headsCalled[1])
+	assert.Equal(t, high.Head, s.headsCalled[2])
+	assert.Equal(t, mid.Head, s.headsCalled[3])
+	assert.Equal(t, dispatcher.EnqueueForced, reasons[0])
+	assert.Equal(t, dispatcher.EnqueueGossip, reasons[2])
+	assert.Equal(t, uint64(0), testDispatch.DropReasons()[dispatcher.DropReasonDuplicate])
+}
+
+func TestDispatcherForceTargetWhenFull(t *testing.T) {
+	tf.UnitTest(t)
+	nt := &noopTransitioner{}
+	heights := func(st dispatcher.DispatcherState) []abi.ChainEpoch {
+		hs := []abi.ChainEpoch{st.InFlight.Height}
+		for _, q := range st.Queue {
+			hs = append(hs, q.Height)
+		}
+		return hs
+	}
+
+	t.Run("evicts lowest", func(t *testing.T) {
+		s := newBlockingSyncer()
+		testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 2, 20)
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 5)))
+		assert.NoError(t, testDispatch.ForceTarget(*chainInfoFromHeight(t, 3), 1))
+		testDispatch.Start(context.Background())
+		<-s.started
+		defer close(s.release)
+
+		assert.Equal(t, []abi.ChainEpoch{3, 10}, heights(testDispatch.State()))
+		drops := testDispatch.RecentDrops()
+		require.Equal(t, 1, len(drops))
+		assert.Equal(t, abi.ChainEpoch(5), drops[0].Height)
+		assert.Equal(t, dispatcher.DropReasonFull, drops[0].Reason)
+	})
+
+	t.Run("already queued", func(t *testing.T) {
+		s := newBlockingSyncer()
+		testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 2, 20)
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 5)))
+		assert.NoError(t, testDispatch.ForceTarget(*chainInfoFromHeight(t, 5), 1))
+		testDispatch.Start(context.Background())
+		<-s.started
+		defer close(s.release)
+
+		assert.Equal(t, []abi.ChainEpoch{5, 10}, heights(testDispatch.State()))
+		assert.Empty(t, testDispatch.RecentDrops())
+	})
+
+	t.Run("all forced", func(t *testing.T) {
+		s := newBlockingSyncer()
+		testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 2, 20)
+		for i, h := range []int{10, 5, 3} {
+			assert.NoError(t, testDispatch.ForceTarget(*chainInfoFromHeight(t, h), i))
+		}
+		testDispatch.Start(context.Background())
+		<-s.started
+		defer close(s.release)
+
+		assert.Equal(t, []abi.ChainEpoch{3, 5, 10}, heights(testDispatch.State()))
+		assert.Empty(t, testDispatch.RecentDrops())
+	})
+}
+
+func TestDispatcherStalePruningSparesForced(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	headHeight := func() (abi.ChainEpoch, error) { return 6, nil }
+	evicted := make(chan dispatcher.Target, 10)
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithHeadHeight(headHeight),
+		dispatcher.WithStalePruning(time.Second, func(target dispatcher.Target) { evicted <- target }),
+	)
+
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 5)))
+	assert.NoError(t, testDispatch.ForceTarget(*chainInfoFromHeight(t, 3), 1))
+	assert.NoError(t, testDispatch.ForceTarget(*chainInfoFromHeight(t, 4), 2))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Second)
+	assert.Equal(t, abi.ChainEpoch(5), (<-evicted).Height)
+	st := testDispatch.State()
+	require.Equal(t, 2, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(3), st.Queue[0].Height)
+	assert.Equal(t, abi.ChainEpoch(10), st.Queue[1].Height)
+}
+
+func TestDispatcherPriorityBands(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	headHeight := func() (abi.ChainEpoch, error) { return 1000, nil }
+	bands := []dispatcher.PriorityBand{
+		{MaxDistance: 100, Priority: 2},
+		{MaxDistance: 1000, Priority: 1},
+	}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithHeadHeight(headHeight),
+		dispatcher.WithPriorityBands(bands),
+	)
+
+	cis := []*block.ChainInfo{
+		chainInfoFromHeight(t, 5000), // no band
+		chainInfoFromHeight(t, 1500),
+		chainInfoFromHeight(t, 1050),
+		chainInfoFromHeight(t, 1080),
+	}
+	allDone := moresync.NewLatch(uint(len(cis)))
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	for _, ci := range cis {
+		assert.NoError(t, testDispatch.SendGossipBlock(ci))
+	}
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	// bands take precedence over height, height orders within a band
+	require.Equal(t, 4, len(s.headsCalled))
+	assert.Equal(t, cis[3].Head, s.headsCalled[0])
+	assert.Equal(t, cis[2].Head, s.headsCalled[1])
+	assert.Equal(t, cis[1].Head, s.headsCalled[2])
+	assert.Equal(t, cis[0].Head, s.headsCalled[3])
+}
+
+func TestDispatcherPriorityBandsReadHeadOncePerReorder(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	var readsLk sync.Mutex
+	reads := 0
+	headHeight := func() (abi.ChainEpoch, error) {
+		readsLk.Lock()
+		defer readsLk.Unlock()
+		reads++
+		// the head moves on every read
+		return abi.ChainEpoch(1000 * reads), nil
+	}
+	bands := []dispatcher.PriorityBand{{MaxDistance: 100, Priority: 1}}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithHeadHeight(headHeight),
+		dispatcher.WithPriorityBands(bands),
+	)
+
+	for _, h := range []int{5000, 1050, 1500, 2000, 990} {
+		assert.NoError(t, testDispatch.SendGossipBlock(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	readsLk.Lock()
+	assert.Equal(t, 1, reads)
+	readsLk.Unlock()
+	// the queue is banded against the single head read
+	st := testDispatch.State()
+	assert.Equal(t, abi.ChainEpoch(1050), st.InFlight.Height)
+	require.Equal(t, 4, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(990), st.Queue[0].Height)
+	assert.Equal(t, abi.ChainEpoch(5000), st.Queue[1].Height)
+}
+
+func TestDispatcherCancelRange(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+
+	// 10 is synced first and blocks the dispatcher while the rest are queued
+	cis := []*block.ChainInfo{
+		chainInfoFromHeight(t, 10),
+		chainInfoFromHeight(t, 1),
+		chainInfoFromHeight(t, 2),
+		chainInfoFromHeight(t, 3),
+		chainInfoFromHeight(t, 4),
+		chainInfoFromHeight(t, 5),
+	}
+	allDone := moresync.NewLatch(3)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	for _, ci := range cis {
+		assert.NoError(t, testDispatch.SendHello(ci))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
+
+	// Both ends of the range are cancelled
+	assert.Equal(t, 3, testDispatch.CancelRange(2, 4))
+	assert.Equal(t, 0, testDispatch.CancelRange(6, 9))
+	close(s.release)
+	allDone.Wait()
+
+	heads := s.heads()
+	require.Equal(t, 3, len(heads))
+	assert.Equal(t, cis[0].Head, heads[0])
+	assert.Equal(t, cis[5].Head, heads[1])
+	assert.Equal(t, cis[1].Head, heads[2])
+}
+
+func TestDispatcherCancelRangeQuarantined(t *testing.T) {
+	tf.UnitTest(t)
+	testDispatch := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, &noopTransitioner{}, 20, 20,
+		dispatcher.WithQuarantineLimits(1, 20),
+	)
+	testDispatch.FlagSuspect(peer.ID("sybil"))
+	from := func(h int, p string) *block.ChainInfo {
+		ci := chainInfoFromHeight(t, h)
+		ci.Sender = peer.ID(p)
+		return ci
+	}
+	testDispatch.PausePops()
+	testDispatch.Start(context.Background())
+	assert.NoError(t, testDispatch.SendHello(from(7, "honest")))
+	assert.NoError(t, testDispatch.SendGossipBlock(from(8, "sybil")))
+	require.Eventually(t, func() bool { return len(testDispatch.Quarantined()) == 1 }, time.Second, time.Millisecond)
+
+	// the queued and the quarantined target are cancelled
+	assert.Equal(t, 2, testDispatch.CancelRange(7, 8))
+	assert.Empty(t, testDispatch.State().Queue)
+	assert.Empty(t, testDispatch.Quarantined())
+
+	// and the suspect's share of the quarantine is freed
+	assert.NoError(t, testDispatch.SendGossipBlock(from(6, "sybil")))
+	require.Eventually(t, func() bool { return len(testDispatch.Quarantined()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(0), testDispatch.DropReasons()[dispatcher.DropReasonQuarantineFull])
+}
+
+func TestDispatcherDropReasons(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 3, 20)
+
+	allDone := moresync.NewLatch(3)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 1)))
+	// duplicate of a queued head
+	assert.NoError(t, testDispatch.SendGossipBlock(chainInfoFromHeight(t, 1)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 2)))
+	// no room left on the work queue
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 3)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 4)))
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	assert.Equal(t, map[string]uint64{
+		dispatcher.DropReasonDuplicate: 1,
+		dispatcher.DropReasonFull:      2,
+	}, testDispatch.DropReasons())
+}
+
+func TestDispatcherDumpJSON(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20, dispatcher.WithUrgency(func(block.ChainInfo) int { return 0 }))
+
+	inFlight := chainInfoFromHeight(t, 10)
+	inFlight.Sender = peer.ID("sender")
+	assert.NoError(t, testDispatch.SendHello(inFlight))
+	assert.NoError(t, testDispatch.SendGossipBlock(chainInfoFromHeight(t, 4)))
+	assert.NoError(t, testDispatch.SendGossipBlock(chainInfoFromHeight(t, 4)))
+	assert.NoError(t, testDispatch.SendOwnBlock(chainInfoFromHeight(t, 7)))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	var buf bytes.Buffer
+	require.NoError(t, testDispatch.DumpJSON(&buf))
+	var st dispatcher.DispatcherState
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &st))
+
+	require.NotNil(t, st.InFlight)
+	assert.Equal(t, inFlight.Head, st.InFlight.Head)
+	assert.Equal(t, peer.IDB58Encode(inFlight.Sender), st.InFlight.Sender)
+	assert.Equal(t, dispatcher.EnqueueBootstrap, st.InFlight.Reason)
+	require.Equal(t, 2, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(7), st.Queue[0].Height)
+	assert.Equal(t, dispatcher.EnqueueOwnBlock, st.Queue[0].Reason)
+	assert.Equal(t, abi.ChainEpoch(4), st.Queue[1].Height)
+	assert.Equal(t, 20, st.WorkQueueSize)
+	assert.Equal(t, uint64(0), st.SyncTargetCount)
+	assert.Equal(t, map[string]uint64{dispatcher.DropReasonDuplicate: 1}, st.DropReasons)
+	assert.True(t, st.Policies.Urgency)
+	assert.False(t, st.Policies.Scored)
+	assert.Equal(t, dispatcher.DefaultDuplicateSampleSize, st.Policies.DuplicateSampleSize)
+}
+
+func TestDispatcherStatePolicies(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	bands := []dispatcher.PriorityBand{{MaxDistance: 10, Priority: 1}}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithHeadHeight(func() (abi.ChainEpoch, error) { return 0, nil }),
+		dispatcher.WithPriorityBands(bands),
+		dispatcher.WithTieStrategy(dispatcher.TieMostPeers),
+		dispatcher.WithReservedCapacity(0.25),
+		dispatcher.WithSyncDeadline(time.Minute),
+		dispatcher.WithMaxSyncRetries(5),
+		dispatcher.WithDedupKey(func(ci block.ChainInfo) string { return ci.Head.String() }),
+		dispatcher.WithAncestryOracle(&fakeAncestry{}),
+		dispatcher.WithPeerLatency(func(peer.ID) time.Duration { return 0 }),
+		dispatcher.WithReorderInterval(time.Second),
+		dispatcher.WithDepthThresholds(func(int, bool) {}, 2, 4),
+		dispatcher.WithQuarantineLimits(2, 8),
+	)
+	testDispatch.FlagSuspect(peer.ID("sybil"))
+	testDispatch.WatchHeights(9, 3)
+	suspect := chainInfoFromHeight(t, 6)
+	suspect.Sender = peer.ID("sybil")
+	expiry := time.Unix(1234567890, 0)
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendGossipBlock(suspect))
+	assert.NoError(t, testDispatch.ReceiveWithExpiry(chainInfoFromHeight(t, 5), expiry))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	st := testDispatch.State()
+	assert.Equal(t, bands, st.Policies.Bands)
+	assert.Equal(t, dispatcher.TieMostPeers, st.Policies.TieStrategy)
+	assert.Equal(t, 0.25, st.Policies.ReservedFraction)
+	assert.Equal(t, time.Minute, st.Policies.SyncDeadline)
+	assert.Equal(t, 5, st.Policies.MaxSyncRetries)
+	assert.True(t, st.Policies.DedupKey)
+	assert.True(t, st.Policies.Ancestry)
+	assert.True(t, st.Policies.PeerLatency)
+	assert.Equal(t, time.Second, st.Policies.ReorderInterval)
+	assert.Equal(t, []int{2, 4}, st.Policies.DepthThresholds)
+	assert.Equal(t, 2, st.Policies.QuarantinePerSuspect)
+	assert.Equal(t, 8, st.Policies.QuarantineSize)
+	assert.Equal(t, []abi.ChainEpoch{3, 9}, st.Policies.WatchedHeights)
+	assert.Equal(t, []string{peer.IDB58Encode(peer.ID("sybil"))}, st.Suspects)
+	require.Equal(t, 1, len(st.Quarantined))
+	assert.Equal(t, suspect.Head, st.Quarantined[0].Head)
+	require.Equal(t, 1, len(st.Queue))
+	assert.True(t, expiry.Equal(st.Queue[0].Expiry))
+
+	// policies left unset are reported as such
+	st = dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20).State()
+	assert.False(t, st.Policies.Ancestry)
+	assert.False(t, st.Policies.DedupKey)
+	assert.Equal(t, dispatcher.DefaultMaxSyncRetries, st.Policies.MaxSyncRetries)
+	assert.Empty(t, st.Policies.WatchedHeights)
+	assert.Empty(t, st.Suspects)
+	assert.Empty(t, st.Quarantined)
+}
+
+func TestDispatcherPrunesStaleTargets(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	var headLk sync.Mutex
+	head := abi.ChainEpoch(0)
+	headHeight := func() (abi.ChainEpoch, error) {
+		headLk.Lock()
+		defer headLk.Unlock()
+		return head, nil
+	}
+	evicted := make(chan dispatcher.Target, 10)
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithHeadHeight(headHeight),
+		dispatcher.WithStalePruning(time.Second, func(target dispatcher.Target) { evicted <- target }),
+	)
+
+	for _, h := range []int{10, 3, 5, 8} {
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// nothing is below the head yet
+	fc.BlockUntil(1)
+	fc.Advance(time.Second)
+	fc.BlockUntil(1)
+	assert.Equal(t, 3, len(testDispatch.State().Queue))
+
+	headLk.Lock()
+	head = 6
+	headLk.Unlock()
+	fc.Advance(time.Second)
+	pruned := []abi.ChainEpoch{(<-evicted).Height, (<-evicted).Height}
+	assert.ElementsMatch(t, []abi.ChainEpoch{3, 5}, pruned)
+
+	st := testDispatch.State()
+	require.Equal(t, 1, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(8), st.Queue[0].Height)
+	assert.Equal(t, uint64(2), st.DropReasons[dispatcher.DropReasonStale])
+}
+
+func TestDispatcherWatchHeights(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	headHeight := func() (abi.ChainEpoch, error) { return 6, nil }
+	evicted := make(chan dispatcher.Target, 10)
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithHeadHeight(headHeight),
+		dispatcher.WithStalePruning(time.Second, func(target dispatcher.Target) { evicted <- target }),
+	)
+
+	for _, h := range []int{10, 3, 5, 8} {
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// the watched target outranks the taller 8
+	testDispatch.WatchHeights(3)
+	st := testDispatch.State()
+	require.Equal(t, 3, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(3), st.Queue[0].Height)
+
+	// and survives pruning below the head
+	fc.BlockUntil(1)
+	fc.Advance(time.Second)
+	assert.Equal(t, abi.ChainEpoch(5), (<-evicted).Height)
+	st = testDispatch.State()
+	require.Equal(t, 2, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(3), st.Queue[0].Height)
+	assert.Equal(t, abi.ChainEpoch(8), st.Queue[1].Height)
+}
+
+func TestDispatcherPrimaryTarget(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+
+	_, ok := testDispatch.PrimaryTarget()
+	assert.False(t, ok)
+
+	for _, h := range []int{10, 3, 7, 5} {
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	primary, ok := testDispatch.PrimaryTarget()
+	require.True(t, ok)
+	st := testDispatch.State()
+	assert.Equal(t, st.Queue[0].Head, primary.Head)
+	assert.Equal(t, abi.ChainEpoch(7), primary.Height)
+
+	// reading the primary target leaves the queue untouched
+	again, ok := testDispatch.PrimaryTarget()
+	require.True(t, ok)
+	assert.Equal(t, primary.Head, again.Head)
+	assert.Equal(t, st.Queue, testDispatch.State().Queue)
+}
+
+func TestDispatcherBestAsCheckpoint(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+
+	_, _, ok := testDispatch.BestAsCheckpoint()
+	assert.False(t, ok)
+
+	for _, h := range []int{10, 3, 7, 5} {
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// the in-flight target is ahead of the queue top
+	head, height, ok := testDispatch.BestAsCheckpoint()
+	require.True(t, ok)
+	assert.Equal(t, chainInfoFromHeight(t, 10).Head, head)
+	assert.Equal(t, abi.ChainEpoch(10), height)
+}
+
+func TestDispatcherBestAsCheckpointPrefersQueued(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 5)))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// a forced target imported behind the in-flight one is ordered first
+	exporter := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20)
+	exporter.PausePops()
+	exporter.Start(context.Background())
+	assert.NoError(t, exporter.ForceTarget(*chainInfoFromHeight(t, 3), 1))
+	require.Eventually(t, func() bool { return len(exporter.State().Queue) == 1 }, time.Second, time.Millisecond)
+	var exported bytes.Buffer
+	require.NoError(t, exporter.ExportQueue(&exported, dispatcher.QueueFormatCBOR))
+	require.NoError(t, testDispatch.ImportQueue(&exported, dispatcher.QueueFormatCBOR))
+	head, height, ok := testDispatch.BestAsCheckpoint()
+	require.True(t, ok)
+	assert.Equal(t, chainInfoFromHeight(t, 3).Head, head)
+	assert.Equal(t, abi.ChainEpoch(3), height)
+}
+
+func TestDispatcherAgreementRatio(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithAnnouncementWindow(time.Minute),
+	)
+	assert.Equal(t, float64(0), testDispatch.AgreementRatio())
+
+	send := func(ci *block.ChainInfo, from string) {
+		announced := *ci
+		announced.Sender = peer.ID(from)
+		assert.NoError(t, testDispatch.SendGossipBlock(&announced))
+	}
+	top := chainInfoFromHeight(t, 9)
+	fork := chainInfoFromHeight(t, 5)
+	behind := chainInfoFromHeight(t, 3)
+	send(top, "a")
+	send(top, "b")
+	send(fork, "c")
+	send(top, "c") // only a peer's latest announcement counts
+	send(fork, "d")
+	send(behind, "e")
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// a, b and c agree on the in-flight top target, d and e do not
+	assert.InDelta(t, 0.6, testDispatch.AgreementRatio(), 1e-9)
+
+	// announcements outside the window no longer count
+	fc.Advance(2 * time.Minute)
+	send(top, "d")
+	assert.Equal(t, float64(1), testDispatch.AgreementRatio())
+}
+
+func TestDispatcherBestKnownHead(t *testing.T) {
+	tf.UnitTest(t)
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithAnnouncementWindow(time.Minute),
+	)
+	_, _, sources := testDispatch.BestKnownHead()
+	assert.Equal(t, 0, sources)
+
+	send := func(ci *block.ChainInfo, from string) {
+		announced := *ci
+		announced.Sender = peer.ID(from)
+		assert.NoError(t, testDispatch.SendGossipBlock(&announced))
+	}
+	x, y, z := chainInfoFromHeight(t, 7), chainInfoFromHeight(t, 9), chainInfoFromHeight(t, 12)
+	// the tallest head's announcement ages out of the window
+	send(z, "d")
+	fc.Advance(2 * time.Minute)
+	send(x, "a")
+	send(x, "b")
+	send(y, "c")
+
+	head, height, sources := testDispatch.BestKnownHead()
+	assert.Equal(t, x.Head, head)
+	assert.Equal(t, abi.ChainEpoch(7), height)
+	assert.Equal(t, 2, sources)
+
+	// b moves to the competing head, which now has more sources
+	send(y, "b")
+	head, height, sources = testDispatch.BestKnownHead()
+	assert.Equal(t, y.Head, head)
+	assert.Equal(t, abi.ChainEpoch(9), height)
+	assert.Equal(t, 2, sources)
+
+	// the node's own blocks are not announcements
+	for _, p := range []string{"self", "a"} {
+		own := chainInfoFromHeight(t, 30)
+		own.Sender = peer.ID(p)
+		assert.NoError(t, testDispatch.SendOwnBlock(own))
+	}
+	head, _, sources = testDispatch.BestKnownHead()
+	assert.Equal(t, y.Head, head)
+	assert.Equal(t, 2, sources)
+	assert.NotContains(t, testDispatch.PeerActivity(), peer.ID("self"))
+}
+
+func TestDispatcherTieMostPeersForgetsStaleAnnouncements(t *testing.T) {
+	tf.UnitTest(t)
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithAnnouncementWindow(time.Minute),
+		dispatcher.WithTieStrategy(dispatcher.TieMostPeers),
+	)
+	send := func(ci *block.ChainInfo, from string) {
+		announced := *ci
+		announced.Sender = peer.ID(from)
+		assert.NoError(t, testDispatch.SendGossipBlock(&announced))
+	}
+	x, y := chainInfoFromHeightAndSeed(t, 5, "x"), chainInfoFromHeightAndSeed(t, 5, "y")
+	testDispatch.PausePops()
+	send(x, "a")
+	send(x, "b")
+	testDispatch.Start(context.Background())
+
+	// a and b's announcements of x age out of the window before c
+	// announces y
+	fc.Advance(2 * time.Minute)
+	send(y, "c")
+	require.Eventually(t, func() bool {
+		return len(testDispatch.State().Queue) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, y.Head, testDispatch.State().Queue[0].Head)
+}
+
+func TestDispatcherPeerActivity(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+
+	send := func(h int, from string) {
+		ci := chainInfoFromHeight(t, h)
+		ci.Sender = peer.ID(from)
+		assert.NoError(t, testDispatch.SendGossipBlock(ci))
+	}
+	send(3, "a")
+	send(3, "b") // duplicates still count as activity
+	send(4, "a")
+	send(5, "a")
+	send(5, "c")
+	// forcing a head is not an announcement
+	forced := chainInfoFromHeight(t, 6)
+	forced.Sender = peer.ID("d")
+	assert.NoError(t, testDispatch.ForceTarget(*forced, 1))
+
+	assert.Equal(t, map[peer.ID]uint64{
+		peer.ID("a"): 3,
+		peer.ID("b"): 1,
+		peer.ID("c"): 1,
+	}, testDispatch.PeerActivity())
+}
+
+func TestDispatcherClassify(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{}
+	nt := &noopTransitioner{}
+	headHeight := func() (abi.ChainEpoch, error) { return 100, nil }
+	target := func(h int) *dispatcher.Target {
+		return &dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, h))}
+	}
+
+	t.Run("default gaps", func(t *testing.T) {
+		testDispatch := dispatcher.NewDispatcher(s, nt, dispatcher.WithHeadHeight(headHeight))
+		assert.Equal(t, dispatcher.SyncClassTip, testDispatch.Classify(target(90)))
+		assert.Equal(t, dispatcher.SyncClassTip, testDispatch.Classify(target(100)))
+		assert.Equal(t, dispatcher.SyncClassTip, testDispatch.Classify(target(101)))
+		assert.Equal(t, dispatcher.SyncClassShallow, testDispatch.Classify(target(102)))
+		assert.Equal(t, dispatcher.SyncClassShallow, testDispatch.Classify(target(110)))
+		assert.Equal(t, dispatcher.SyncClassDeep, testDispatch.Classify(target(111)))
+	})
+
+	t.Run("configured gaps", func(t *testing.T) {
+		testDispatch := dispatcher.NewDispatcher(s, nt,
+			dispatcher.WithHeadHeight(headHeight),
+			dispatcher.WithSyncClassGaps(5, 50),
+		)
+		assert.Equal(t, dispatcher.SyncClassTip, testDispatch.Classify(target(105)))
+		assert.Equal(t, dispatcher.SyncClassShallow, testDispatch.Classify(target(106)))
+		assert.Equal(t, dispatcher.SyncClassShallow, testDispatch.Classify(target(150)))
+		assert.Equal(t, dispatcher.SyncClassDeep, testDispatch.Classify(target(151)))
+	})
+
+	t.Run("unknown head", func(t *testing.T) {
+		testDispatch := dispatcher.NewDispatcher(s, nt)
+		assert.Equal(t, dispatcher.SyncClassUnknown, testDispatch.Classify(target(105)))
+	})
+}
+
+func TestDispatcherPausePops(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+
+	allDone := moresync.NewLatch(4)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	testDispatch.Start(context.Background())
+	<-s.started
+
+	testDispatch.PausePops()
+	for _, h := range []int{3, 5, 4} {
+		assert.NoError(t, testDispatch.SendGossipBlock(chainInfoFromHeight(t, h)))
+	}
+	close(s.release)
+
+	// receives are still queued while pops are paused
+	require.Eventually(t, func() bool {
+		return len(testDispatch.State().Queue) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, len(s.heads()))
+
+	testDispatch.ResumePops()
+	allDone.Wait()
+	heads := s.heads()
+	require.Equal(t, 4, len(heads))
+	assert.Equal(t, chainInfoFromHeight(t, 5).Head, heads[1])
+	assert.Equal(t, chainInfoFromHeight(t, 4).Head, heads[2])
+	assert.Equal(t, chainInfoFromHeight(t, 3).Head, heads[3])
+}
+
+func TestDispatcherReservedCapacity(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 10, 20, dispatcher.WithReservedCapacity(0.3))
+
+	// a gossip flood can only take up the unreserved 7 slots
+	for h := 1; h <= 10; h++ {
+		assert.NoError(t, testDispatch.SendGossipBlock(chainInfoFromHeight(t, h)))
+	}
+	hello := chainInfoFromHeight(t, 100)
+	assert.NoError(t, testDispatch.SendHello(hello))
+	own := chainInfoFromHeight(t, 0)
+	assert.NoError(t, testDispatch.SendOwnBlock(own))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// the hello made it through the flood and is synced first
+	assert.Equal(t, []block.TipSetKey{hello.Head}, s.heads())
+	st := testDispatch.State()
+	require.Equal(t, 8, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(7), st.Queue[0].Height)
+	assert.Equal(t, own.Head, st.Queue[7].Head)
+	assert.Equal(t, uint64(3), st.DropReasons[dispatcher.DropReasonFull])
+}
+
+func TestDispatcherReservedCapacityClamped(t *testing.T) {
+	tf.UnitTest(t)
+	for fraction, want := range map[float64]float64{-0.5: 0, 1.5: 1} {
+		testDispatch := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, &noopTransitioner{}, 10, 20, dispatcher.WithReservedCapacity(fraction))
+		assert.Equal(t, want, testDispatch.State().Policies.ReservedFraction)
+	}
+}
+
+func TestDispatcherRecentDrops(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 2, 20, dispatcher.WithRecentDropsSize(3))
+	assert.Empty(t, testDispatch.RecentDrops())
+
+	allDone := moresync.NewLatch(2)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 9)))
+	// queue full from here
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 8)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 7)))
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	// only the latest 3 of 4 drops are kept
+	drops := testDispatch.RecentDrops()
+	require.Equal(t, 3, len(drops))
+	assert.Equal(t, abi.ChainEpoch(10), drops[0].Height)
+	assert.Equal(t, dispatcher.DropReasonDuplicate, drops[0].Reason)
+	assert.Equal(t, abi.ChainEpoch(8), drops[1].Height)
+	assert.Equal(t, dispatcher.DropReasonFull, drops[1].Reason)
+	assert.Equal(t, abi.ChainEpoch(7), drops[2].Height)
+	assert.Equal(t, dispatcher.DropReasonFull, drops[2].Reason)
+	assert.Equal(t, uint64(2), testDispatch.DropReasons()[dispatcher.DropReasonDuplicate])
+}
+
+func TestDispatcherRecentDropsNegativeSize(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, &noopTransitioner{}, 2, 20, dispatcher.WithRecentDropsSize(-1))
+	allDone := moresync.NewLatch(1)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	// the duplicate is counted but not retained
+	require.Eventually(t, func() bool {
+		return testDispatch.DropReasons()[dispatcher.DropReasonDuplicate] == 1
+	}, time.Second, time.Millisecond)
+	assert.Empty(t, testDispatch.RecentDrops())
+}
+
+func TestDispatcherReceiveWithExpiry(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20, dispatcher.WithClock(fc))
+
+	allDone := moresync.NewLatch(3)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.ReceiveWithExpiry(chainInfoFromHeight(t, 7), fc.Now().Add(time.Minute)))
+	assert.NoError(t, testDispatch.ReceiveWithExpiry(chainInfoFromHeight(t, 6), fc.Now().Add(time.Hour)))
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 5)))
+	testDispatch.Start(context.Background())
+	<-s.started
+
+	// the target at 7 expires while 10 is syncing
+	fc.Advance(2 * time.Minute)
+	close(s.release)
+	allDone.Wait()
+
+	assert.Equal(t, []block.TipSetKey{
+		chainInfoFromHeight(t, 10).Head,
+		chainInfoFromHeight(t, 6).Head,
+		chainInfoFromHeight(t, 5).Head,
+	}, s.heads())
+	drops := testDispatch.RecentDrops()
+	require.Equal(t, 1, len(drops))
+	assert.Equal(t, abi.ChainEpoch(7), drops[0].Height)
+	assert.Equal(t, dispatcher.DropReasonExpired, drops[0].Reason)
+	assert.Equal(t, dispatcher.EnqueueExpiring, drops[0].Target.Reason)
+}
+
+func TestDispatcherDepthThresholds(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	type crossing struct {
+		threshold int
+		up        bool
+	}
+	var lk sync.Mutex
+	var crossings []crossing
+	onCross := func(threshold int, crossedUp bool) {
+		lk.Lock()
+		defer lk.Unlock()
+		crossings = append(crossings, crossing{threshold, crossedUp})
+	}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithDepthThresholds(onCross, 2, 4),
+	)
+
+	allDone := moresync.NewLatch(3)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	for _, h := range []int{10, 7, 5} {
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+
+	// 7 and 5 stay queued while 10 syncs
+	<-s.started
+	lk.Lock()
+	assert.Equal(t, []crossing{{2, true}}, crossings)
+	lk.Unlock()
+
+	// popping 7 takes the queue back below 2
+	close(s.release)
+	allDone.Wait()
+	lk.Lock()
+	defer lk.Unlock()
+	assert.Equal(t, []crossing{{2, true}, {2, false}}, crossings)
+}
+
+func TestDispatcherDepthThresholdsDeliveredInOrder(t *testing.T) {
+	tf.UnitTest(t)
+	nt := &noopTransitioner{}
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var lk sync.Mutex
+	var crossedUp []bool
+	onCross := func(_ int, up bool) {
+		lk.Lock()
+		crossedUp = append(crossedUp, up)
+		first := len(crossedUp) == 1
+		lk.Unlock()
+		if first {
+			close(entered)
+			<-release
+		}
+	}
+	testDispatch := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20,
+		dispatcher.WithDepthThresholds(onCross, 1),
+	)
+
+	// queueing 5 crosses up, and the dispatcher blocks delivering it
+	testDispatch.PausePops()
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 5)))
+	testDispatch.Start(context.Background())
+	<-entered
+
+	// the crossing down waits for the first delivery to finish
+	assert.Equal(t, 1, testDispatch.CancelRange(0, 10))
+	lk.Lock()
+	assert.Equal(t, []bool{true}, crossedUp)
+	lk.Unlock()
+
+	close(release)
+	require.Eventually(t, func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(crossedUp) == 2
+	}, time.Second, time.Millisecond)
+	lk.Lock()
+	defer lk.Unlock()
+	assert.Equal(t, []bool{true, false}, crossedUp)
+}
+
+func TestDispatcherAncestrySubsumption(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	head := func(h int) block.TipSetKey { return chainInfoFromHeight(t, h).Head }
+	// 8 descends from 5 and 6, nothing is known about 10 and 3
+	oracle := &fakeAncestry{ancestors: map[string][]block.TipSetKey{
+		head(8).String(): {head(6), head(5)},
+	}}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20, dispatcher.WithAncestryOracle(oracle))
+
+	allDone := moresync.NewLatch(3)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	// 5 is queued, then removed when its descendant 8 arrives. 6 arrives
+	// after its descendant and is never queued.
+	for _, h := range []int{10, 5, 8, 6, 3} {
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+	allDone.Wait()
+
+	assert.Equal(t, []block.TipSetKey{head(10), head(8), head(3)}, s.headsCalled)
+	drops := testDispatch.RecentDrops()
+	require.Equal(t, 2, len(drops))
+	assert.Equal(t, abi.ChainEpoch(5), drops[0].Height)
+	assert.Equal(t, abi.ChainEpoch(6), drops[1].Height)
+	assert.Equal(t, uint64(2), testDispatch.DropReasons()[dispatcher.DropReasonSubsumed])
+}
+
+func TestDispatcherGraphDOT(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+	head := func(h int) block.TipSetKey { return chainInfoFromHeight(t, h).Head }
+
+	for _, h := range []int{10, 8, 6, 5} {
+		assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// 8 descends from 6 and 5, 6 from 5
+	oracle := &fakeAncestry{ancestors: map[string][]block.TipSetKey{
+		head(8).String(): {head(6), head(5)},
+		head(6).String(): {head(5)},
+	}}
+	var buf bytes.Buffer
+	require.NoError(t, testDispatch.GraphDOT(&buf, oracle))
+	dot := buf.String()
+
+	assert.True(t, strings.HasPrefix(dot, "digraph targets {\n"))
+	assert.Contains(t, dot, fmt.Sprintf("t0 [label=%q];", fmt.Sprintf("%s\nheight 8", head(8))))
+	assert.Contains(t, dot, fmt.Sprintf("t1 [label=%q];", fmt.Sprintf("%s\nheight 6", head(6))))
+	assert.Contains(t, dot, fmt.Sprintf("t2 [label=%q];", fmt.Sprintf("%s\nheight 5", head(5))))
+	assert.NotContains(t, dot, "t3")
+	assert.Contains(t, dot, "t1 -> t0;")
+	assert.Contains(t, dot, "t2 -> t0;")
+	assert.Contains(t, dot, "t2 -> t1;")
+	assert.Equal(t, 3, strings.Count(dot, "->"))
+}
+
+func TestDispatcherTieStrategy(t *testing.T) {
+	tf.UnitTest(t)
+	// a and b are competing forks at height 5, with a the smaller head
+	a := chainInfoFromHeightAndSeed(t, 5, "a")
+	b := chainInfoFromHeightAndSeed(t, 5, "b")
+	if a.Head.String() > b.Head.String() {
+		a, b = b, a
+	}
+	syncedOrder := func(strategy dispatcher.TieStrategy) []block.TipSetKey {
+		s := &mockSyncer{
+			headsCalled: make([]block.TipSetKey, 0),
+		}
+		nt := &noopTransitioner{}
+		testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20, dispatcher.WithTieStrategy(strategy))
+		allDone := moresync.NewLatch(2)
+		testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+		// more peers announce b than a
+		for _, announced := range []struct {
+			ci   *block.ChainInfo
+			from string
+		}{{a, "x"}, {b, "y"}, {b, "z"}} {
+			ci := *announced.ci
+			ci.Sender = peer.ID(announced.from)
+			assert.NoError(t, testDispatch.SendHello(&ci))
+		}
+		testDispatch.Start(context.Background())
+		allDone.Wait()
+		return s.headsCalled
+	}
+
+	t.Run("most peers", func(t *testing.T) {
+		assert.Equal(t, []block.TipSetKey{b.Head, a.Head}, syncedOrder(dispatcher.TieMostPeers))
+	})
+
+	t.Run("smallest head", func(t *testing.T) {
+		assert.Equal(t, []block.TipSetKey{a.Head, b.Head}, syncedOrder(dispatcher.TieSmallestHead))
+	})
+}
+
+func TestDispatcherSubsumptionSparesWatched(t *testing.T) {
+	tf.UnitTest(t)
+	nt := &noopTransitioner{}
+	head := func(h int) block.TipSetKey { return chainInfoFromHeight(t, h).Head }
+	oracle := &fakeAncestry{ancestors: map[string][]block.TipSetKey{
+		head(8).String(): {head(5)},
+	}}
+
+	// the watched 5 is queued whether it arrives before or after its
+	// descendant 8
+	for name, order := range map[string][]int{
+		"queued first":  {10, 5, 8},
+		"arrives after": {10, 8, 5},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := &mockSyncer{
+				headsCalled: make([]block.TipSetKey, 0),
+			}
+			testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20, dispatcher.WithAncestryOracle(oracle))
+			testDispatch.WatchHeights(5)
+
+			allDone := moresync.NewLatch(3)
+			testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+			for _, h := range order {
+				assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, h)))
+			}
+			testDispatch.Start(context.Background())
+			allDone.Wait()
+
+			assert.Equal(t, []block.TipSetKey{head(5), head(10), head(8)}, s.headsCalled)
+			assert.Empty(t, testDispatch.RecentDrops())
+		})
+	}
+}
+
+func TestDispatcherQuarantinesSuspects(t *testing.T) {
+	tf.UnitTest(t)
+	s := &mockSyncer{
+		headsCalled: make([]block.TipSetKey, 0),
+	}
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithQuarantineWindow(time.Minute),
+	)
+	testDispatch.FlagSuspect(peer.ID("sybil"))
+	from := func(h int, p string) *block.ChainInfo {
+		ci := chainInfoFromHeight(t, h)
+		ci.Sender = peer.ID(p)
+		return ci
+	}
+
+	allDone := moresync.NewLatch(3)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	testDispatch.PausePops()
+	testDispatch.Start(context.Background())
+	assert.NoError(t, testDispatch.SendHello(from(10, "honest")))
+	assert.NoError(t, testDispatch.SendGossipBlock(from(7, "sybil")))
+	assert.NoError(t, testDispatch.SendGossipBlock(from(6, "sybil")))
+	assert.NoError(t, testDispatch.SendHello(from(5, "honest")))
+	require.Eventually(t, func() bool { return len(testDispatch.Quarantined()) == 2 }, time.Second, time.Millisecond)
+
+	// only the honest targets are queued
+	st := testDispatch.State()
+	require.Equal(t, 2, len(st.Queue))
+	assert.Equal(t, abi.ChainEpoch(10), st.Queue[0].Height)
+	assert.Equal(t, abi.ChainEpoch(5), st.Queue[1].Height)
+
+	// an honest peer corroborates 7 while 6 stays uncorroborated past the
+	// window
+	assert.NoError(t, testDispatch.SendGossipBlock(from(7, "honest")))
+	require.Eventually(t, func() bool { return len(testDispatch.Quarantined()) == 1 }, time.Second, time.Millisecond)
+	fc.Advance(time.Minute)
+	require.Eventually(t, func() bool { return len(testDispatch.Quarantined()) == 0 }, time.Second, time.Millisecond)
+	testDispatch.ResumePops()
+	allDone.Wait()
+
+	assert.Equal(t, []block.TipSetKey{
+		chainInfoFromHeight(t, 10).Head,
+		chainInfoFromHeight(t, 7).Head,
+		chainInfoFromHeight(t, 5).Head,
+	}, s.headsCalled)
+	assert.Equal(t, uint64(1), testDispatch.DropReasons()[dispatcher.DropReasonUncorroborated])
+}
+
+func TestDispatcherQuarantineExpiresDuringSync(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithQuarantineWindow(time.Minute),
+	)
+	testDispatch.FlagSuspect(peer.ID("sybil"))
+	sybil := chainInfoFromHeight(t, 6)
+	sybil.Sender = peer.ID("sybil")
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendGossipBlock(sybil))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+	require.Equal(t, 1, len(testDispatch.Quarantined()))
+
+	// the suspect's target expires while 10 is still being synced
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
+	require.Eventually(t, func() bool { return len(testDispatch.Quarantined()) == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), testDispatch.DropReasons()[dispatcher.DropReasonUncorroborated])
+}
+
+func TestDispatcherQuarantineLimits(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithQuarantineLimits(1, 2),
+	)
+	for _, p := range []string{"sybil1", "sybil2", "sybil3"} {
+		testDispatch.FlagSuspect(peer.ID(p))
+	}
+	from := func(h int, p string) *block.ChainInfo {
+		ci := chainInfoFromHeight(t, h)
+		ci.Sender = peer.ID(p)
+		return ci
+	}
+
+	assert.NoError(t, testDispatch.SendHello(from(10, "honest")))
+	assert.NoError(t, testDispatch.SendGossipBlock(from(7, "sybil1")))
+	// beyond sybil1's share
+	assert.NoError(t, testDispatch.SendGossipBlock(from(6, "sybil1")))
+	assert.NoError(t, testDispatch.SendGossipBlock(from(8, "sybil2")))
+	// beyond the quarantine size
+	assert.NoError(t, testDispatch.SendGossipBlock(from(9, "sybil3")))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	var quarantined []abi.ChainEpoch
+	for _, q := range testDispatch.Quarantined() {
+		quarantined = append(quarantined, q.Height)
+	}
+	assert.ElementsMatch(t, []abi.ChainEpoch{7, 8}, quarantined)
+	drops := testDispatch.RecentDrops()
+	require.Equal(t, 2, len(drops))
+	assert.Equal(t, abi.ChainEpoch(6), drops[0].Height)
+	assert.Equal(t, abi.ChainEpoch(9), drops[1].Height)
+	assert.Equal(t, uint64(2), testDispatch.DropReasons()[dispatcher.DropReasonQuarantineFull])
+}
+
+func TestDispatcherQuarantineAfterFullCheck(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 1, 20)
+	testDispatch.FlagSuspect(peer.ID("sybil"))
+	sybil := chainInfoFromHeight(t, 7)
+	sybil.Sender = peer.ID("sybil")
+
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, testDispatch.SendGossipBlock(sybil))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// the full queue drops the suspect's target before it can be quarantined
+	assert.Empty(t, testDispatch.Quarantined())
+	assert.Equal(t, uint64(1), testDispatch.DropReasons()[dispatcher.DropReasonFull])
+}
+
+func TestDispatcherAttemptLog(t *testing.T) {
+	tf.UnitTest(t)
+	s := &failingSyncer{failFrom: map[peer.ID]struct{}{
+		peer.ID("flaky"):  {},
+		peer.ID("broken"): {},
+	}}
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20, dispatcher.WithClock(fc))
+	synced := make(chan error)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, err error) { synced <- err })
+	testDispatch.Start(context.Background())
+
+	ci := chainInfoFromHeight(t, 5)
+	syncFrom := func(p string) error {
+		from := *ci
+		from.Sender = peer.ID(p)
+		assert.NoError(t, testDispatch.SendHello(&from))
+		return <-synced
 	}
+	assert.Empty(t, testDispatch.AttemptLog(ci.Head))
+
+	assert.Error(t, syncFrom("flaky"))
+	fc.Advance(time.Second)
+	assert.Error(t, syncFrom("broken"))
+	attempts := testDispatch.AttemptLog(ci.Head)
+	require.Equal(t, 2, len(attempts))
+	assert.Equal(t, peer.ID("flaky"), attempts[0].Peer)
+	assert.Contains(t, attempts[0].Err.Error(), "can't serve")
+	assert.Equal(t, fc.Now().Add(-time.Second), attempts[0].At)
+	assert.Equal(t, peer.ID("broken"), attempts[1].Peer)
+	assert.Equal(t, fc.Now(), attempts[1].At)
+
+	// syncing the head clears its log
+	assert.NoError(t, syncFrom("honest"))
+	assert.Empty(t, testDispatch.AttemptLog(ci.Head))
+}
+
+func TestDispatcherAttemptLogBounded(t *testing.T) {
+	tf.UnitTest(t)
+	s := &failingSyncer{failFrom: map[peer.ID]struct{}{peer.ID("broken"): {}}}
 	nt := &noopTransitioner{}
-	testDispatch := dispatcher.NewDispatcher(s, nt)
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+	synced := make(chan error)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, err error) { synced <- err })
+	testDispatch.Start(context.Background())
 
-	cis := []*block.ChainInfo{
-		// We need to put these in priority order to avoid a race.
-		// If we send 0 before 42, it is possible the dispatcher will
-		// pick up 0 and start processing before it sees 42.
-		chainInfoFromHeight(t, 42),
-		chainInfoFromHeight(t, 16),
-		chainInfoFromHeight(t, 3),
-		chainInfoFromHeight(t, 2),
-		chainInfoFromHeight(t, 0),
+	failFrom := func(ci *block.ChainInfo) {
+		from := *ci
+		from.Sender = peer.ID("broken")
+		assert.NoError(t, testDispatch.SendHello(&from))
+		assert.Error(t, <-synced)
 	}
+	first := chainInfoFromHeight(t, 1)
+	failFrom(first)
+	for h := 2; h <= dispatcher.AttemptLogHeads; h++ {
+		failFrom(chainInfoFromHeight(t, h))
+	}
+	assert.Equal(t, 1, len(testDispatch.AttemptLog(first.Head)))
+
+	// the least recently failed head is evicted
+	failFrom(chainInfoFromHeight(t, dispatcher.AttemptLogHeads+1))
+	assert.Empty(t, testDispatch.AttemptLog(first.Head))
+	assert.Equal(t, 1, len(testDispatch.AttemptLog(chainInfoFromHeight(t, 2).Head)))
+
+	// dropping a head's target clears its log
+	retried := chainInfoFromHeight(t, 2)
+	testDispatch.PausePops()
+	assert.NoError(t, testDispatch.SendHello(retried))
+	require.Eventually(t, func() bool {
+		return len(testDispatch.State().Queue) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 1, len(testDispatch.AttemptLog(retried.Head)))
+	assert.Equal(t, 1, testDispatch.CancelRange(2, 2))
+	assert.Empty(t, testDispatch.AttemptLog(retried.Head))
+}
+
+func TestDispatcherMarginalBenefit(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+	target := func(h int) *dispatcher.Target {
+		return &dispatcher.Target{ChainInfo: *chainInfoFromHeight(t, h)}
+	}
+	assert.Equal(t, abi.ChainEpoch(8), testDispatch.MarginalBenefit(target(8)))
 
+	synced := moresync.NewLatch(1)
+	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { synced.Done() })
+	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 10)))
 	testDispatch.Start(context.Background())
+	<-s.started
 
-	// set up a blocking channel and register to unblock after 5 synced
-	allDone := moresync.NewLatch(5)
+	// targets below the in-flight target add nothing
+	assert.Equal(t, abi.ChainEpoch(0), testDispatch.MarginalBenefit(target(8)))
+	assert.Equal(t, abi.ChainEpoch(0), testDispatch.MarginalBenefit(target(10)))
+	assert.Equal(t, abi.ChainEpoch(2), testDispatch.MarginalBenefit(target(12)))
+
+	// nor do targets below a synced one
+	close(s.release)
+	synced.Wait()
+	assert.Equal(t, abi.ChainEpoch(0), testDispatch.MarginalBenefit(target(8)))
+	assert.Equal(t, abi.ChainEpoch(2), testDispatch.MarginalBenefit(target(12)))
+}
+
+func TestDispatcherMarginalBenefitForks(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	inFlight := chainInfoFromHeightAndSeed(t, 10, "main")
+	ancestor := chainInfoFromHeightAndSeed(t, 8, "main")
+	fa := &fakeAncestry{ancestors: map[string][]block.TipSetKey{
+		inFlight.Head.String(): {ancestor.Head},
+	}}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20, dispatcher.WithAncestryOracle(fa))
+	assert.NoError(t, testDispatch.SendHello(inFlight))
+	testDispatch.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+
+	// the in-flight target only covers its own ancestors
+	benefit := func(ci *block.ChainInfo) abi.ChainEpoch {
+		return testDispatch.MarginalBenefit(&dispatcher.Target{ChainInfo: *ci})
+	}
+	assert.Equal(t, abi.ChainEpoch(0), benefit(ancestor))
+	assert.Equal(t, abi.ChainEpoch(0), benefit(inFlight))
+	assert.Equal(t, abi.ChainEpoch(10), benefit(chainInfoFromHeightAndSeed(t, 10, "fork")))
+	assert.Equal(t, abi.ChainEpoch(8), benefit(chainInfoFromHeightAndSeed(t, 8, "fork")))
+}
+
+func TestDispatcherPeerLatency(t *testing.T) {
+	tf.UnitTest(t)
+	a := chainInfoFromHeightAndSeed(t, 5, "a")
+	a.Sender = peer.ID("a")
+	b := chainInfoFromHeightAndSeed(t, 5, "b")
+	b.Sender = peer.ID("b")
+	syncedOrder := func(latencies map[peer.ID]time.Duration) []block.TipSetKey {
+		s := &mockSyncer{
+			headsCalled: make([]block.TipSetKey, 0),
+		}
+		nt := &noopTransitioner{}
+		testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+			dispatcher.WithPeerLatency(func(p peer.ID) time.Duration { return latencies[p] }),
+		)
+		allDone := moresync.NewLatch(2)
+		testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+		assert.NoError(t, testDispatch.SendHello(a))
+		assert.NoError(t, testDispatch.SendHello(b))
+		testDispatch.Start(context.Background())
+		allDone.Wait()
+		return s.headsCalled
+	}
+
+	assert.Equal(t, []block.TipSetKey{a.Head, b.Head}, syncedOrder(map[peer.ID]time.Duration{
+		peer.ID("a"): 20 * time.Millisecond,
+		peer.ID("b"): 300 * time.Millisecond,
+	}))
+	assert.Equal(t, []block.TipSetKey{b.Head, a.Head}, syncedOrder(map[peer.ID]time.Duration{
+		peer.ID("a"): 300 * time.Millisecond,
+		peer.ID("b"): 20 * time.Millisecond,
+	}))
+}
+
+func TestDispatcherPeerLatencyChanges(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	var lk sync.Mutex
+	latencies := map[peer.ID]time.Duration{
+		peer.ID("a"): 20 * time.Millisecond,
+		peer.ID("b"): 300 * time.Millisecond,
+	}
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithPeerLatency(func(p peer.ID) time.Duration {
+			lk.Lock()
+			defer lk.Unlock()
+			return latencies[p]
+		}),
+	)
+	a := chainInfoFromHeightAndSeed(t, 5, "a")
+	a.Sender = peer.ID("a")
+	b := chainInfoFromHeightAndSeed(t, 5, "b")
+	b.Sender = peer.ID("b")
+	blocker := chainInfoFromHeight(t, 10)
+	allDone := moresync.NewLatch(3)
 	testDispatch.RegisterCallback(func(t dispatcher.Target, _ error) { allDone.Done() })
+	for _, ci := range []*block.ChainInfo{blocker, a, b} {
+		assert.NoError(t, testDispatch.SendHello(ci))
+	}
+	testDispatch.Start(context.Background())
+	<-s.started
 
-	// receive requests before Start() to test deterministic order
+	// b becomes the closer peer while both are queued
+	lk.Lock()
+	latencies[peer.ID("a")], latencies[peer.ID("b")] = 300*time.Millisecond, 20*time.Millisecond
+	lk.Unlock()
+	close(s.release)
+	allDone.Wait()
+
+	assert.Equal(t, []block.TipSetKey{blocker.Head, b.Head, a.Head}, s.heads())
+}
+
+// stallingSyncer hangs syncing its stall head until the sync is cancelled.
+// Other heads sync immediately.
+type stallingSyncer struct {
+	stall block.TipSetKey
+
+	lk          sync.Mutex
+	headsCalled []block.TipSetKey
+}
+
+func (ss *stallingSyncer) HandleNewTipSet(ctx context.Context, ci *block.ChainInfo, _ bool) error {
+	ss.lk.Lock()
+	ss.headsCalled = append(ss.headsCalled, ci.Head)
+	ss.lk.Unlock()
+	if ci.Head.Equals(ss.stall) {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func TestDispatcherStateDuringSyncTimeouts(t *testing.T) {
+	tf.UnitTest(t)
+	const timeouts = 50
+	stalled := chainInfoFromHeight(t, 10)
+	s := &stallingSyncer{stall: stalled.Head}
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithSyncDeadline(time.Minute),
+		dispatcher.WithMaxSyncRetries(timeouts-1),
+	)
+	assert.NoError(t, testDispatch.SendHello(stalled))
+	testDispatch.Start(context.Background())
+
+	// snapshots taken while timed out targets are requeued don't race
+	done := make(chan struct{})
+	polled := make(chan struct{})
 	go func() {
-		for _, ci := range cis {
-			assert.NoError(t, testDispatch.SendHello(ci))
+		defer close(polled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if st := testDispatch.State(); st.InFlight != nil {
+					assert.Equal(t, stalled.Head, st.InFlight.Head)
+				}
+			}
 		}
 	}()
-	allDone.Wait()
-
-	// check that the mockSyncer synced in order
-	require.Equal(t, 5, len(s.headsCalled))
-	for i := range cis {
-		assert.Equal(t, cis[i].Head, s.headsCalled[i])
+	for i := 0; i < timeouts; i++ {
+		fc.BlockUntil(1)
+		fc.Advance(time.Minute)
 	}
+	require.Eventually(t, func() bool {
+		return testDispatch.DropReasons()[dispatcher.DropReasonRetries] == 1
+	}, time.Second, time.Millisecond)
+	close(done)
+	<-polled
 }
 
-func TestDispatcherDropsWhenFull(t *testing.T) {
+func TestDispatcherSyncRetriesExhausted(t *testing.T) {
 	tf.UnitTest(t)
-	s := &mockSyncer{
-		headsCalled: make([]block.TipSetKey, 0),
+	stalled := chainInfoFromHeight(t, 10)
+	other := chainInfoFromHeight(t, 5)
+	s := &stallingSyncer{stall: stalled.Head}
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithSyncDeadline(time.Minute),
+		dispatcher.WithMaxSyncRetries(1),
+	)
+	synced := make(chan dispatcher.Target, 1)
+	testDispatch.RegisterCallback(func(target dispatcher.Target, _ error) { synced <- target })
+	assert.NoError(t, testDispatch.SendHello(stalled))
+	assert.NoError(t, testDispatch.SendHello(other))
+	testDispatch.Start(context.Background())
+
+	// the stalled target is demoted behind 5 once it times out
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
+	assert.Equal(t, other.Head, (<-synced).Head)
+
+	// and dropped when it times out again
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
+	require.Eventually(t, func() bool {
+		return testDispatch.DropReasons()[dispatcher.DropReasonRetries] == 1
+	}, time.Second, time.Millisecond)
+	drops := testDispatch.RecentDrops()
+	require.Equal(t, 1, len(drops))
+	assert.Equal(t, stalled.Head, drops[0].Head)
+	assert.Equal(t, 2, drops[0].Retries)
+	assert.Empty(t, testDispatch.State().Queue)
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	assert.Equal(t, []block.TipSetKey{stalled.Head, other.Head, stalled.Head}, s.headsCalled)
+}
+
+func TestDispatcherSyncRetriesExhaustedCompletesWaiters(t *testing.T) {
+	tf.UnitTest(t)
+	stalled := chainInfoFromHeight(t, 10)
+	s := &stallingSyncer{stall: stalled.Head}
+	nt := &noopTransitioner{}
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithSyncDeadline(time.Minute),
+		dispatcher.WithMaxSyncRetries(1),
+	)
+	wait := testDispatch.WaiterForTarget(stalled.Head)
+	assert.NoError(t, testDispatch.SendHello(stalled))
+	testDispatch.Start(context.Background())
+
+	for i := 0; i < 2; i++ {
+		fc.BlockUntil(1)
+		fc.Advance(time.Minute)
 	}
+	err := wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dropped after timing out 2 times")
+}
+
+func TestDispatcherSyncDeadline(t *testing.T) {
+	tf.UnitTest(t)
+	s := &hangingSyncer{}
 	nt := &noopTransitioner{}
-	testWorkSize := 20
-	testBufferSize := 30
-	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, testWorkSize, testBufferSize)
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testDispatch := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithClock(fc),
+		dispatcher.WithSyncDeadline(time.Minute),
+	)
 
+	var synced dispatcher.Target
+	var syncErr error
 	finished := moresync.NewLatch(1)
-	testDispatch.RegisterCallback(func(target dispatcher.Target, _ error) {
-		// Fail if the work that should be dropped gets processed
-		assert.False(t, target.Height == 100)
-		assert.False(t, target.Height == 101)
-		assert.False(t, target.Height == 102)
-		if target.Height == 0 {
-			// 0 has lowest priority of non-dropped
-			finished.Done()
-		}
+	testDispatch.RegisterCallback(func(target dispatcher.Target, err error) {
+		synced = target
+		syncErr = err
+		finished.Done()
 	})
-	for j := 0; j < testWorkSize; j++ {
-		ci := chainInfoFromHeight(t, j)
-		assert.NoError(t, testDispatch.SendHello(ci))
-	}
-	// Should be dropped
-	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 100)))
-	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 101)))
-	assert.NoError(t, testDispatch.SendHello(chainInfoFromHeight(t, 102)))
-
+	ci := chainInfoFromHeight(t, 5)
+	assert.NoError(t, testDispatch.SendHello(ci))
 	testDispatch.Start(context.Background())
 
+	// the first sync hangs until the deadline passes, then is retried
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute)
 	finished.Wait()
+
+	assert.NoError(t, syncErr)
+	assert.Equal(t, ci.Head, synced.Head)
+	assert.Equal(t, 1, synced.Retries)
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	assert.Equal(t, []block.TipSetKey{ci.Head, ci.Head}, s.headsCalled)
 }
 
 func TestQueueHappy(t *testing.T) {
@@ -169,6 +2039,20 @@ func TestQueueDuplicates(t *testing.T) {
 	assert.Equal(t, abi.ChainEpoch(0), second.ChainInfo.Height)
 }
 
+func TestQueuePushReportsDuplicates(t *testing.T) {
+	tf.UnitTest(t)
+	testQ := dispatcher.NewTargetQueue()
+	sR0 := dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 0))}
+	sR0dup := dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 0))}
+
+	assert.True(t, testQ.Push(sR0))
+	assert.False(t, testQ.Push(sR0dup))
+
+	// A popped target is no longer a duplicate
+	_ = requirePop(t, testQ)
+	assert.True(t, testQ.Push(sR0dup))
+}
+
 func TestQueueEmptyPopErrors(t *testing.T) {
 	tf.UnitTest(t)
 	testQ := dispatcher.NewTargetQueue()
@@ -191,6 +2075,356 @@ func TestQueueEmptyPopErrors(t *testing.T) {
 
 }
 
+func TestQueueEmptyPeek(t *testing.T) {
+	tf.UnitTest(t)
+	testQ := dispatcher.NewTargetQueue()
+	_, peeked := testQ.Peek()
+	assert.False(t, peeked)
+
+	// Peeking doesn't find popped targets either
+	testQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 0))})
+	_ = requirePop(t, testQ)
+	_, peeked = testQ.Peek()
+	assert.False(t, peeked)
+}
+
+func TestQueueChainsComparators(t *testing.T) {
+	tf.UnitTest(t)
+	heavy := dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 1))}
+	tallA := dispatcher.Target{ChainInfo: *(chainInfoFromHeightAndSeed(t, 9, "a"))}
+	tallB := dispatcher.Target{ChainInfo: *(chainInfoFromHeightAndSeed(t, 9, "b"))}
+	short := dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 3))}
+
+	weights := map[string]int{heavy.Head.String(): 10}
+	byWeight := func(a, b dispatcher.Target) int {
+		return compareInts(weights[b.Head.String()], weights[a.Head.String()])
+	}
+	// lower sequence numbers were seen first and are preferred
+	sequence := map[string]int{
+		heavy.Head.String(): 0,
+		tallB.Head.String(): 1,
+		tallA.Head.String(): 2,
+		short.Head.String(): 3,
+	}
+	bySequence := func(a, b dispatcher.Target) int {
+		return compareInts(sequence[a.Head.String()], sequence[b.Head.String()])
+	}
+
+	testQ := dispatcher.NewTargetQueue(byWeight, dispatcher.ByHeight, bySequence)
+	testQ.Push(short)
+	testQ.Push(tallA)
+	testQ.Push(heavy)
+	testQ.Push(tallB)
+
+	// weight decides first, then height, then sequence
+	assert.Equal(t, heavy.Head, requirePop(t, testQ).Head)
+	assert.Equal(t, tallB.Head, requirePop(t, testQ).Head)
+	assert.Equal(t, tallA.Head, requirePop(t, testQ).Head)
+	assert.Equal(t, short.Head, requirePop(t, testQ).Head)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func TestQueuePreservesPeer(t *testing.T) {
+	tf.UnitTest(t)
+	testQ := dispatcher.NewTargetQueue()
+	sender := peer.ID("sender")
+	ci := chainInfoFromHeight(t, 7)
+	ci.Source = peer.ID("originator")
+	ci.Sender = sender
+
+	testQ.Push(dispatcher.Target{ChainInfo: *ci})
+	out := requirePop(t, testQ)
+	assert.Equal(t, sender, out.Peer())
+	assert.Equal(t, ci.Source, out.Source)
+}
+
+func TestQueueOrdered(t *testing.T) {
+	tf.UnitTest(t)
+	testQ := dispatcher.NewTargetQueue()
+	clone := dispatcher.NewTargetQueue()
+	for _, h := range []int{4, 9, 1, 7, 3, 8} {
+		testQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, h))})
+		clone.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, h))})
+	}
+
+	var ordered []block.TipSetKey
+	testQ.Ordered(func(target dispatcher.Target) bool {
+		ordered = append(ordered, target.Head)
+		return true
+	})
+	// the queue is left intact
+	assert.Equal(t, 6, testQ.Len())
+
+	require.Equal(t, 6, len(ordered))
+	for _, head := range ordered {
+		assert.Equal(t, requirePop(t, clone).Head, head)
+	}
+
+	// yield can stop the walk early
+	var first []block.TipSetKey
+	testQ.Ordered(func(target dispatcher.Target) bool {
+		first = append(first, target.Head)
+		return len(first) < 2
+	})
+	assert.Equal(t, ordered[:2], first)
+	assert.Equal(t, ordered[0], requirePop(t, testQ).Head)
+}
+
+func TestQueueHeights(t *testing.T) {
+	tf.UnitTest(t)
+	testQ := dispatcher.NewTargetQueue()
+	assert.Empty(t, testQ.Heights())
+
+	for _, h := range []int{7, 2, 9, 7, 4, 2, 7} {
+		testQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeightAndSeed(t, h, strconv.Itoa(testQ.Len())))})
+	}
+	require.Equal(t, 7, testQ.Len())
+	assert.Equal(t, []abi.ChainEpoch{2, 4, 7, 9}, testQ.Heights())
+}
+
+func TestQueueSiblingGroups(t *testing.T) {
+	tf.UnitTest(t)
+	testQ := dispatcher.NewTargetQueue()
+	assert.Empty(t, testQ.SiblingGroups())
+
+	a9 := chainInfoFromHeightAndSeed(t, 9, "a")
+	b9 := chainInfoFromHeightAndSeed(t, 9, "b")
+	a4 := chainInfoFromHeightAndSeed(t, 4, "a")
+	b4 := chainInfoFromHeightAndSeed(t, 4, "b")
+	c4 := chainInfoFromHeightAndSeed(t, 4, "c")
+	for _, ci := range []*block.ChainInfo{a4, a9, chainInfoFromHeight(t, 6), b4, b9, c4} {
+		testQ.Push(dispatcher.Target{ChainInfo: *ci})
+	}
+
+	groups := testQ.SiblingGroups()
+	require.Equal(t, 2, len(groups))
+	assert.ElementsMatch(t, []block.TipSetKey{a9.Head, b9.Head}, groups[0])
+	assert.ElementsMatch(t, []block.TipSetKey{a4.Head, b4.Head, c4.Head}, groups[1])
+	// the queue is left intact
+	assert.Equal(t, 6, testQ.Len())
+}
+
+func TestQueueReorderInterval(t *testing.T) {
+	tf.UnitTest(t)
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testQ := dispatcher.NewTargetQueue()
+	testQ.SetReorderInterval(fc, time.Second)
+
+	// the first push orders the queue, the burst following it does not
+	testQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 1))})
+	for _, h := range []int{4, 9, 3, 7} {
+		testQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, h))})
+	}
+	// peeking finds the best target of the unordered queue
+	head, ok := testQ.Peek()
+	require.True(t, ok)
+	assert.Equal(t, abi.ChainEpoch(9), head.Height)
+
+	// walking the queue orders the walk regardless
+	var heights []abi.ChainEpoch
+	testQ.Ordered(func(target dispatcher.Target) bool {
+		heights = append(heights, target.Height)
+		return true
+	})
+	assert.Equal(t, []abi.ChainEpoch{9, 7, 4, 3, 1}, heights)
+
+	// once the interval elapses the next pop restores the order
+	fc.Advance(time.Second)
+	for _, h := range heights {
+		assert.Equal(t, h, requirePop(t, testQ).Height)
+	}
+}
+
+func TestQueueReorderIntervalPopsBest(t *testing.T) {
+	tf.UnitTest(t)
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	testQ := dispatcher.NewTargetQueue()
+	testQ.SetReorderInterval(fc, time.Second)
+	for _, h := range []int{1, 4, 9, 3} {
+		testQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, h))})
+	}
+
+	// pops within the interval agree with peeks
+	for _, h := range []abi.ChainEpoch{9, 4, 3, 1} {
+		head, ok := testQ.Peek()
+		require.True(t, ok)
+		assert.Equal(t, h, head.Height)
+		assert.Equal(t, h, requirePop(t, testQ).Height)
+	}
+	_, ok := testQ.Pop()
+	assert.False(t, ok)
+}
+
+func TestQueuePopResult(t *testing.T) {
+	tf.UnitTest(t)
+	testQ := dispatcher.NewTargetQueue()
+	_, ok := testQ.PopResult()
+	assert.False(t, ok)
+
+	left := chainInfoFromHeightAndSeed(t, 5, "left")
+	right := chainInfoFromHeightAndSeed(t, 5, "right")
+	for _, ci := range []*block.ChainInfo{chainInfoFromHeight(t, 9), left, right} {
+		testQ.Push(dispatcher.Target{ChainInfo: *ci})
+	}
+
+	res, ok := testQ.PopResult()
+	require.True(t, ok)
+	assert.Equal(t, abi.ChainEpoch(9), res.Height)
+	assert.Equal(t, dispatcher.DecidedHeight, res.Decider)
+	assert.False(t, res.PoliciesApplied)
+	assert.Equal(t, int64(0), res.Score)
+
+	res, ok = testQ.PopResult()
+	require.True(t, ok)
+	tied := res.Head
+	assert.Equal(t, dispatcher.DecidedTie, res.Decider)
+	assert.False(t, res.PoliciesApplied)
+
+	res, ok = testQ.PopResult()
+	require.True(t, ok)
+	assert.ElementsMatch(t, []block.TipSetKey{left.Head, right.Head}, []block.TipSetKey{tied, res.Head})
+	assert.Equal(t, dispatcher.DecidedAlone, res.Decider)
+	assert.False(t, res.PoliciesApplied)
+
+	// scored queues report the memoized score
+	scoredQ := dispatcher.NewScoredTargetQueue(func(target dispatcher.Target) int64 {
+		return -int64(target.Height)
+	})
+	scoredQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 9))})
+	scoredQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, 3))})
+	res, ok = scoredQ.PopResult()
+	require.True(t, ok)
+	assert.Equal(t, abi.ChainEpoch(3), res.Height)
+	assert.Equal(t, int64(-3), res.Score)
+	assert.Equal(t, dispatcher.DecidedPolicy, res.Decider)
+	assert.True(t, res.PoliciesApplied)
+}
+
+func TestScoredQueueMemoizesScores(t *testing.T) {
+	tf.UnitTest(t)
+	calls := 0
+	// prefer lower heights to show the score, not the height, decides
+	score := func(target dispatcher.Target) int64 {
+		calls++
+		return -int64(target.Height)
+	}
+	testQ := dispatcher.NewScoredTargetQueue(score)
+	for _, h := range []int{4, 9, 1, 7, 3, 8} {
+		testQ.Push(dispatcher.Target{ChainInfo: *(chainInfoFromHeight(t, h))})
+	}
+	for _, h := range []int{1, 3, 4, 7, 8, 9} {
+		assert.Equal(t, abi.ChainEpoch(h), requirePop(t, testQ).Height)
+	}
+	assert.Equal(t, 6, calls)
+}
+
+// costlyScore simulates a score requiring weight or ancestry lookups.
+func costlyScore(target dispatcher.Target) int64 {
+	score := int64(target.Height)
+	for i := int64(0); i < 200; i++ {
+		score = (score*31 + i) % 1000003
+	}
+	return score
+}
+
+func benchmarkTargets(n int) []dispatcher.Target {
+	newCid := types.NewCidForTestGetter()
+	targets := make([]dispatcher.Target, n)
+	for i := range targets {
+		targets[i] = dispatcher.Target{ChainInfo: block.ChainInfo{
+			Head:   block.NewTipSetKey(newCid()),
+			Height: abi.ChainEpoch(i),
+		}}
+	}
+	return targets
+}
+
+func benchmarkQueue(b *testing.B, newQueue func() *dispatcher.TargetQueue) {
+	targets := benchmarkTargets(2000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		testQ := newQueue()
+		for _, target := range targets {
+			testQ.Push(target)
+		}
+		for testQ.Len() > 0 {
+			testQ.Pop()
+		}
+	}
+}
+
+// benchmarkBurst measures ordering a burst of pushes: the burst is pushed,
+// afterBurst is called if set and the best target is popped.
+func benchmarkBurst(b *testing.B, newQueue func() *dispatcher.TargetQueue, afterBurst func()) {
+	targets := benchmarkTargets(2000)
+	ordered := newQueue()
+	for _, target := range targets {
+		ordered.Push(target)
+	}
+	if afterBurst != nil {
+		afterBurst()
+	}
+	want, _ := ordered.Pop()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		testQ := newQueue()
+		for _, target := range targets {
+			testQ.Push(target)
+		}
+		if afterBurst != nil {
+			afterBurst()
+		}
+		if best, _ := testQ.Pop(); !best.Head.Equals(want.Head) {
+			b.Fatalf("popped height %d, not the best target", best.Height)
+		}
+	}
+}
+
+func recomputedScore(x, y dispatcher.Target) int {
+	return compareInts(int(costlyScore(y)), int(costlyScore(x)))
+}
+
+func BenchmarkQueueRecomputedScore(b *testing.B) {
+	benchmarkQueue(b, func() *dispatcher.TargetQueue {
+		return dispatcher.NewTargetQueue(recomputedScore)
+	})
+}
+
+func BenchmarkQueueMemoizedScore(b *testing.B) {
+	benchmarkQueue(b, func() *dispatcher.TargetQueue {
+		return dispatcher.NewScoredTargetQueue(costlyScore)
+	})
+}
+
+func BenchmarkQueueBurstPerPushReorder(b *testing.B) {
+	benchmarkBurst(b, func() *dispatcher.TargetQueue {
+		return dispatcher.NewTargetQueue(recomputedScore)
+	}, nil)
+}
+
+// BenchmarkQueueBurstGovernedReorder orders the whole burst with a single
+// heap initialization on the first pop after the interval.
+func BenchmarkQueueBurstGovernedReorder(b *testing.B) {
+	fc := clock.NewFake(time.Unix(1234567890, 0))
+	benchmarkBurst(b, func() *dispatcher.TargetQueue {
+		testQ := dispatcher.NewTargetQueue(recomputedScore)
+		testQ.SetReorderInterval(fc, time.Second)
+		return testQ
+	}, func() {
+		fc.Advance(time.Second)
+	})
+}
+
 // requirePop is a helper requiring that pop does not error
 func requirePop(t *testing.T, q *dispatcher.TargetQueue) dispatcher.Target {
 	req, popped := q.Pop()
@@ -209,3 +2443,14 @@ func chainInfoFromHeight(t *testing.T, h int) *block.ChainInfo {
 		Height: abi.ChainEpoch(h),
 	}
 }
+
+// chainInfoFromHeightAndSeed is a helper that constructs a chain info at the
+// given height with a tipset key faked from both the height and the seed.
+// This is useful for making distinct heads at the same height.
+func chainInfoFromHeightAndSeed(t *testing.T, h int, seed string) *block.ChainInfo {
+	c := types.CidFromString(t, strconv.Itoa(h)+seed)
+	return &block.ChainInfo{
+		Head:   block.NewTipSetKey(c),
+		Height: abi.ChainEpoch(h),
+	}
+}
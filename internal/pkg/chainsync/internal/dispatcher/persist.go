@@ -0,0 +1,192 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+
+	"github.com/filecoin-project/go-filecoin/internal/pkg/block"
+	"github.com/filecoin-project/go-filecoin/internal/pkg/encoding"
+)
+
+// QueueFormat is the serialization format of an exported work queue.
+type QueueFormat int
+
+const (
+	// QueueFormatCBOR is compact and consistent with the rest of go-filecoin.
+	QueueFormatCBOR QueueFormat = iota
+	// QueueFormatJSON is human readable, for debugging.
+	QueueFormatJSON
+)
+
+// persistedTarget is the serialized form of a queued target.  Peer IDs are
+// kept as raw bytes so any ID round-trips, and a zero Expiry means the
+// target does not expire.
+type persistedTarget struct {
+	_        struct{} `cbor:",toarray"`
+	Head     block.TipSetKey
+	Height   abi.ChainEpoch
+	Source   []byte
+	Sender   []byte
+	Reason   EnqueueReason
+	Retries  int
+	Forced   bool
+	Priority int
+	Expiry   int64
+}
+
+func newPersistedTarget(t Target) persistedTarget {
+	pt := persistedTarget{
+		Head:     t.Head,
+		Height:   t.Height,
+		Source:   []byte(t.Source),
+		Sender:   []byte(t.Sender),
+		Reason:   t.Reason,
+		Retries:  t.Retries,
+		Forced:   t.forced,
+		Priority: t.priority,
+	}
+	if !t.expiry.IsZero() {
+		pt.Expiry = t.expiry.UnixNano()
+	}
+	return pt
+}
+
+func (pt persistedTarget) target() Target {
+	t := Target{
+		ChainInfo: block.ChainInfo{
+			Source: peer.ID(pt.Source),
+			Sender: peer.ID(pt.Sender),
+			Head:   pt.Head,
+			Height: pt.Height,
+		},
+		Reason:   pt.Reason,
+		Retries:  pt.Retries,
+		forced:   pt.Forced,
+		priority: pt.Priority,
+	}
+	if pt.Expiry != 0 {
+		t.expiry = time.Unix(0, pt.Expiry)
+	}
+	return t
+}
+
+// ExportQueue writes the queued targets to w in pop order, in the given
+// format, for restoring with ImportQueue.
+func (d *Dispatcher) ExportQueue(w io.Writer, format QueueFormat) error {
+	var targets []persistedTarget
+	for _, t := range d.ordered() {
+		targets = append(targets, newPersistedTarget(t))
+	}
+	return writeTargets(w, format, targets)
+}
+
+// EmergencyFlush writes the in-flight target and the queued targets to w in
+// CBOR, then clears the queue, atomically.  It is meant for panic recovery and
+// shutdown handlers; the dispatcher releases its lock when a policy callback
+// panics, so it may be called after the worker has died.  ImportQueue
+// restores the flushed targets on the next boot.  Only targets are written,
+// the rest of the DispatcherState, such as suspects, quarantine, watched
+// heights and drop records, is not persisted.  The queue is left intact if
+// writing fails.
+func (d *Dispatcher) EmergencyFlush(w io.Writer) error {
+	if err := d.flush(w); err != nil {
+		return err
+	}
+	d.deliverDepthCrossings()
+	return nil
+}
+
+// flush writes the in-flight and queued targets to w and clears the queue.
+func (d *Dispatcher) flush(w io.Writer) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	targets := d.queuedTargets()
+	if d.inFlight != nil {
+		targets = append([]persistedTarget{newPersistedTarget(*d.inFlight)}, targets...)
+	}
+	if err := writeTargets(w, QueueFormatCBOR, targets); err != nil {
+		return err
+	}
+	d.workQueue.removeWhere(func(Target) bool { return true })
+	d.observeDepth()
+	return nil
+}
+
+// queuedTargets returns the persisted form of the queued targets in pop
+// order.  It must be called with the lock held.
+func (d *Dispatcher) queuedTargets() []persistedTarget {
+	var targets []persistedTarget
+	d.workQueue.Ordered(func(t Target) bool {
+		targets = append(targets, newPersistedTarget(t))
+		return true
+	})
+	return targets
+}
+
+// writeTargets encodes persisted targets to w in the given format.
+func writeTargets(w io.Writer, format QueueFormat, targets []persistedTarget) error {
+	switch format {
+	case QueueFormatCBOR:
+		raw, err := encoding.Encode(targets)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode queue")
+		}
+		_, err = w.Write(raw)
+		return err
+	case QueueFormatJSON:
+		return json.NewEncoder(w).Encode(targets)
+	default:
+		return errors.Errorf("unknown queue format %d", format)
+	}
+}
+
+// ImportQueue reads targets written by ExportQueue in the given format from r
+// and queues them.  Targets beyond the work queue's capacity or already
+// queued are dropped.
+func (d *Dispatcher) ImportQueue(r io.Reader, format QueueFormat) error {
+	var targets []persistedTarget
+	switch format {
+	case QueueFormatCBOR:
+		raw, err := ioutil.ReadAll(r)
+		if err != nil {
+			return errors.Wrap(err, "failed to read queue")
+		}
+		if err := encoding.Decode(raw, &targets); err != nil {
+			return errors.Wrap(err, "failed to decode queue")
+		}
+	case QueueFormatJSON:
+		if err := json.NewDecoder(r).Decode(&targets); err != nil {
+			return errors.Wrap(err, "failed to decode queue")
+		}
+	default:
+		return errors.Errorf("unknown queue format %d", format)
+	}
+
+	d.queueImported(targets)
+	d.deliverDepthCrossings()
+	return nil
+}
+
+// queueImported queues imported targets, dropping those beyond the work
+// queue's capacity or already queued.
+func (d *Dispatcher) queueImported(targets []persistedTarget) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	for _, pt := range targets {
+		t := pt.target()
+		if d.workQueue.Len() >= d.workQueueSize {
+			d.recordDrop(t, DropReasonFull)
+			continue
+		}
+		if !d.workQueue.Push(t) {
+			d.recordDrop(t, DropReasonDuplicate)
+		}
+	}
+	d.observeDepth()
+}
@@ -0,0 +1,152 @@
+package dispatcher_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-filecoin/internal/pkg/chainsync/internal/dispatcher"
+	tf "github.com/filecoin-project/go-filecoin/internal/pkg/testhelpers/testflags"
+)
+
+func TestExportImportQueue(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	exporter := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+
+	withPeers := chainInfoFromHeight(t, 7)
+	withPeers.Source = peer.ID("source")
+	withPeers.Sender = peer.ID("sender")
+	assert.NoError(t, exporter.SendHello(chainInfoFromHeight(t, 10)))
+	assert.NoError(t, exporter.SendGossipBlock(withPeers))
+	assert.NoError(t, exporter.ReceiveWithExpiry(chainInfoFromHeight(t, 5), time.Unix(1234567890, 0)))
+	assert.NoError(t, exporter.ForceTarget(*chainInfoFromHeight(t, 3), 2))
+	exporter.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+	want := exporter.State().Queue
+	require.Equal(t, 3, len(want))
+
+	for name, format := range map[string]dispatcher.QueueFormat{
+		"cbor": dispatcher.QueueFormatCBOR,
+		"json": dispatcher.QueueFormatJSON,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var exported bytes.Buffer
+			require.NoError(t, exporter.ExportQueue(&exported, format))
+			raw := append([]byte{}, exported.Bytes()...)
+
+			importer := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20)
+			require.NoError(t, importer.ImportQueue(&exported, format))
+			assert.Equal(t, want, importer.State().Queue)
+
+			// exporting the restored queue reproduces the original export
+			var reexported bytes.Buffer
+			require.NoError(t, importer.ExportQueue(&reexported, format))
+			assert.Equal(t, raw, reexported.Bytes())
+		})
+	}
+}
+
+func TestEmergencyFlush(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	flushed := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20)
+	for _, h := range []int{10, 7, 5} {
+		assert.NoError(t, flushed.SendHello(chainInfoFromHeight(t, h)))
+	}
+	flushed.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+	before := flushed.State()
+	require.NotNil(t, before.InFlight)
+
+	var buf bytes.Buffer
+	require.NoError(t, flushed.EmergencyFlush(&buf))
+	assert.Empty(t, flushed.State().Queue)
+
+	// the in-flight target is restored along with the queue
+	restored := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20)
+	require.NoError(t, restored.ImportQueue(&buf, dispatcher.QueueFormatCBOR))
+	assert.Equal(t, append([]dispatcher.TargetState{*before.InFlight}, before.Queue...), restored.State().Queue)
+}
+
+func TestEmergencyFlushAfterPanic(t *testing.T) {
+	tf.UnitTest(t)
+	panicked := make(chan struct{})
+	var once sync.Once
+	panicOnce := func(a, b dispatcher.Target) int {
+		once.Do(func() {
+			close(panicked)
+			panic("comparator failed")
+		})
+		return dispatcher.ByHeight(a, b)
+	}
+	flushed := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, &noopTransitioner{}, 20, 20,
+		dispatcher.WithComparators([]dispatcher.Comparator{panicOnce}),
+	)
+	for _, h := range []int{10, 7} {
+		assert.NoError(t, flushed.SendHello(chainInfoFromHeight(t, h)))
+	}
+	flushed.Start(context.Background())
+	<-panicked
+
+	// the worker released the lock when it died, so flushing doesn't block
+	flushErr := make(chan error)
+	go func() {
+		var buf bytes.Buffer
+		flushErr <- flushed.EmergencyFlush(&buf)
+	}()
+	select {
+	case err := <-flushErr:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("EmergencyFlush blocked after a panic")
+	}
+}
+
+func TestFlushAndImportObserveDepth(t *testing.T) {
+	tf.UnitTest(t)
+	s := newBlockingSyncer()
+	nt := &noopTransitioner{}
+	flushedCrossedUp := make(chan bool, 4)
+	onCross := func(_ int, up bool) { flushedCrossedUp <- up }
+	flushed := dispatcher.NewDispatcherWithSizes(s, nt, 20, 20,
+		dispatcher.WithDepthThresholds(onCross, 2),
+	)
+	for _, h := range []int{10, 7, 5} {
+		assert.NoError(t, flushed.SendHello(chainInfoFromHeight(t, h)))
+	}
+	flushed.Start(context.Background())
+	<-s.started
+	defer close(s.release)
+	assert.True(t, <-flushedCrossedUp)
+
+	// flushing empties the queue below the threshold
+	var buf bytes.Buffer
+	require.NoError(t, flushed.EmergencyFlush(&buf))
+	assert.False(t, <-flushedCrossedUp)
+
+	// and importing fills another queue above it
+	restoredCrossedUp := make(chan bool, 4)
+	restored := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, nt, 20, 20,
+		dispatcher.WithDepthThresholds(func(_ int, up bool) { restoredCrossedUp <- up }, 2),
+	)
+	require.NoError(t, restored.ImportQueue(&buf, dispatcher.QueueFormatCBOR))
+	assert.True(t, <-restoredCrossedUp)
+}
+
+func TestImportQueueRejectsUnknownFormat(t *testing.T) {
+	tf.UnitTest(t)
+	testDispatch := dispatcher.NewDispatcherWithSizes(&mockSyncer{}, &noopTransitioner{}, 20, 20)
+	assert.Error(t, testDispatch.ExportQueue(&bytes.Buffer{}, dispatcher.QueueFormat(7)))
+	assert.Error(t, testDispatch.ImportQueue(&bytes.Buffer{}, dispatcher.QueueFormat(7)))
+}
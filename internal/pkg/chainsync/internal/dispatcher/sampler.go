@@ -0,0 +1,52 @@
+package dispatcher
+
+import (
+	"math/rand"
+	"time"
+)
+
+// reservoir keeps a uniformly random sample of bounded size from a stream of
+// targets of unknown length (Vitter's algorithm R).
+type reservoir struct {
+	size   int
+	seen   uint64
+	sample []Target
+	rng    *rand.Rand
+}
+
+// newReservoir returns a reservoir sampling at most size targets with rng.
+// A negative size is treated as 0 and a nil rng is seeded from the clock.
+func newReservoir(size int, rng *rand.Rand) *reservoir {
+	if size < 0 {
+		size = 0
+	}
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &reservoir{
+		size:   size,
+		sample: make([]Target, 0, size),
+		rng:    rng,
+	}
+}
+
+// offer considers a target for inclusion in the sample.
+func (r *reservoir) offer(t Target) {
+	r.seen++
+	if len(r.sample) < r.size {
+		r.sample = append(r.sample, t)
+		return
+	}
+	if j := r.rng.Int63n(int64(r.seen)); j < int64(r.size) {
+		r.sample[j] = t
+	}
+}
+
+// drain returns the current sample and the number of targets offered since
+// the last drain, and then resets the reservoir.
+func (r *reservoir) drain() ([]Target, uint64) {
+	sample, seen := r.sample, r.seen
+	r.sample = make([]Target, 0, r.size)
+	r.seen = 0
+	return sample, seen
+}
@@ -0,0 +1,72 @@
+package dispatcher
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/filecoin-project/go-filecoin/internal/pkg/block"
+	tf "github.com/filecoin-project/go-filecoin/internal/pkg/testhelpers/testflags"
+	"github.com/filecoin-project/go-filecoin/internal/pkg/types"
+)
+
+func TestReservoirRespectsSize(t *testing.T) {
+	tf.UnitTest(t)
+	r := newReservoir(5, rand.New(rand.NewSource(1)))
+
+	for i := 0; i < 1000; i++ {
+		r.offer(testTarget(t, i))
+		assert.True(t, len(r.sample) <= 5)
+	}
+	sample, seen := r.drain()
+	assert.Equal(t, 5, len(sample))
+	assert.Equal(t, uint64(1000), seen)
+
+	// draining resets the reservoir
+	r.offer(testTarget(t, 0))
+	sample, seen = r.drain()
+	assert.Equal(t, 1, len(sample))
+	assert.Equal(t, uint64(1), seen)
+}
+
+func TestReservoirIsSeedable(t *testing.T) {
+	tf.UnitTest(t)
+	r1 := newReservoir(3, rand.New(rand.NewSource(7)))
+	r2 := newReservoir(3, rand.New(rand.NewSource(7)))
+	for i := 0; i < 100; i++ {
+		r1.offer(testTarget(t, i))
+		r2.offer(testTarget(t, i))
+	}
+	s1, _ := r1.drain()
+	s2, _ := r2.drain()
+	assert.Equal(t, s1, s2)
+}
+
+func TestReservoirDefaults(t *testing.T) {
+	tf.UnitTest(t)
+	// a nil rng is replaced and a negative size sampled as 0
+	r := newReservoir(-1, nil)
+	for i := 0; i < 10; i++ {
+		r.offer(testTarget(t, i))
+	}
+	sample, seen := r.drain()
+	assert.Empty(t, sample)
+	assert.Equal(t, uint64(10), seen)
+
+	r = newReservoir(2, nil)
+	for i := 0; i < 10; i++ {
+		r.offer(testTarget(t, i))
+	}
+	sample, _ = r.drain()
+	assert.Equal(t, 2, len(sample))
+}
+
+func testTarget(t *testing.T, h int) Target {
+	return Target{ChainInfo: block.ChainInfo{
+		Head:   block.NewTipSetKey(types.CidFromString(t, strconv.Itoa(h))),
+		Height: abi.ChainEpoch(h),
+	}}
+}
@@ -0,0 +1,69 @@
+package constants
+
+import (
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/pkg/errors"
+)
+
+// GenesisSectorConfig holds the proof types and genesis miner bootstrap
+// parameters matching a sector size.
+type GenesisSectorConfig struct {
+	SectorSize abi.SectorSize
+	// SealProofType is the proof a genesis miner seals its sectors with.
+	SealProofType abi.RegisteredProof
+	// WinningPoStProofType and WindowPoStProofType are the PoSt proofs
+	// implied by the seal proof.
+	WinningPoStProofType abi.RegisteredProof
+	WindowPoStProofType  abi.RegisteredProof
+	// WindowPoStPartitionSectors is the number of sectors proven in a
+	// single window PoSt partition.
+	WindowPoStPartitionSectors uint64
+	// PieceSize is the size of a genesis self-deal piece filling a sector.
+	PieceSize abi.PaddedPieceSize
+}
+
+// genesisSealProof returns the seal proof for a sector size supported in
+// genesis templates.
+func genesisSealProof(size abi.SectorSize) (abi.RegisteredProof, bool) {
+	switch size {
+	case DevSectorSize:
+		return DevSealProofType, true
+	case EightMiBSectorSize:
+		return abi.RegisteredProof_StackedDRG8MiBSeal, true
+	case FiveHundredTwelveMiBSectorSize:
+		return abi.RegisteredProof_StackedDRG512MiBSeal, true
+	case ThirtyTwoGiBSectorSize:
+		return abi.RegisteredProof_StackedDRG32GiBSeal, true
+	default:
+		return 0, false
+	}
+}
+
+// GenesisSectorParams returns the genesis template parameters for miners
+// with sectors of the given size.  It errors on unsupported sizes.
+func GenesisSectorParams(size abi.SectorSize) (GenesisSectorConfig, error) {
+	sealProof, ok := genesisSealProof(size)
+	if !ok {
+		return GenesisSectorConfig{}, errors.Errorf("unsupported genesis sector size %d", size)
+	}
+	winningPoSt, err := sealProof.RegisteredWinningPoStProof()
+	if err != nil {
+		return GenesisSectorConfig{}, err
+	}
+	windowPoSt, err := sealProof.RegisteredWindowPoStProof()
+	if err != nil {
+		return GenesisSectorConfig{}, err
+	}
+	partitionSectors, err := sealProof.WindowPoStPartitionSectors()
+	if err != nil {
+		return GenesisSectorConfig{}, err
+	}
+	return GenesisSectorConfig{
+		SectorSize:                 size,
+		SealProofType:              sealProof,
+		WinningPoStProofType:       winningPoSt,
+		WindowPoStProofType:        windowPoSt,
+		WindowPoStPartitionSectors: partitionSectors,
+		PieceSize:                  abi.PaddedPieceSize(size),
+	}, nil
+}
@@ -0,0 +1,63 @@
+package constants_test
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-filecoin/internal/pkg/constants"
+	tf "github.com/filecoin-project/go-filecoin/internal/pkg/testhelpers/testflags"
+)
+
+func TestGenesisSectorParams(t *testing.T) {
+	tf.UnitTest(t)
+
+	t.Run("2KiB", func(t *testing.T) {
+		params, err := constants.GenesisSectorParams(constants.DevSectorSize)
+		require.NoError(t, err)
+		assert.Equal(t, constants.DevSealProofType, params.SealProofType)
+		assert.Equal(t, constants.DevRegisteredWinningPoStProof, params.WinningPoStProofType)
+		assert.Equal(t, constants.DevRegisteredWindowPoStProof, params.WindowPoStProofType)
+		assert.Equal(t, abi.PaddedPieceSize(2048), params.PieceSize)
+	})
+
+	t.Run("8MiB", func(t *testing.T) {
+		params, err := constants.GenesisSectorParams(constants.EightMiBSectorSize)
+		require.NoError(t, err)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG8MiBSeal, params.SealProofType)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG8MiBWinningPoSt, params.WinningPoStProofType)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG8MiBWindowPoSt, params.WindowPoStProofType)
+		assert.Equal(t, abi.PaddedPieceSize(constants.EightMiBSectorSize), params.PieceSize)
+	})
+
+	t.Run("512MiB", func(t *testing.T) {
+		params, err := constants.GenesisSectorParams(constants.FiveHundredTwelveMiBSectorSize)
+		require.NoError(t, err)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG512MiBSeal, params.SealProofType)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG512MiBWinningPoSt, params.WinningPoStProofType)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG512MiBWindowPoSt, params.WindowPoStProofType)
+	})
+
+	t.Run("32GiB", func(t *testing.T) {
+		params, err := constants.GenesisSectorParams(constants.ThirtyTwoGiBSectorSize)
+		require.NoError(t, err)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG32GiBSeal, params.SealProofType)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG32GiBWinningPoSt, params.WinningPoStProofType)
+		assert.Equal(t, abi.RegisteredProof_StackedDRG32GiBWindowPoSt, params.WindowPoStProofType)
+	})
+
+	t.Run("partition sectors come from the seal proof", func(t *testing.T) {
+		params, err := constants.GenesisSectorParams(constants.DevSectorSize)
+		require.NoError(t, err)
+		expected, err := constants.DevSealProofType.WindowPoStPartitionSectors()
+		require.NoError(t, err)
+		assert.Equal(t, expected, params.WindowPoStPartitionSectors)
+	})
+
+	t.Run("unknown size errors", func(t *testing.T) {
+		_, err := constants.GenesisSectorParams(abi.SectorSize(1 << 20))
+		assert.Error(t, err)
+	})
+}